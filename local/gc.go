@@ -0,0 +1,213 @@
+package local
+
+import (
+	"encoding/json"
+	"github.com/ProtoML/ProtoML-persist/persist/elastic"
+	"github.com/ProtoML/ProtoML/logger"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// a key directory no metadata record refers to
+type GarbageEntry struct {
+	Path string
+	Size int64
+}
+
+// the key directories referred to by the records of every namespace and by every sidecar
+func (store *LocalStorage) reachableKeyPaths() (reachable map[string]bool, err error) {
+	reachable = make(map[string]bool)
+	namespaces, err := elastic.ListNamespaces()
+	if err != nil {
+		return
+	}
+	for _, namespace := range namespaces {
+		err = elastic.ExportNamespaceRecords(namespace, func(record elastic.ExportedRecord) error {
+			return store.markReachable(reachable, record)
+		})
+		if err != nil {
+			return
+		}
+	}
+	err = store.markSidecarsReachable(reachable)
+	return
+}
+
+// marks the key directories of a record reachable, with the column directories of dataparts
+func (store *LocalStorage) markReachable(reachable map[string]bool, record elastic.ExportedRecord) (err error) {
+	reachable[store.getKeyPath(RecordKey(record.Type, record.Id))] = true
+	reachable[store.getKeyPath(SidecarKey(record.Namespace, record.Type, record.Id))] = true
+	if record.Type != elastic.DATAPARTS_TYPE {
+		return
+	}
+	// column files live in the datagroup directory but are kept wherever they point
+	var parts dataGroupParts
+	if err = json.Unmarshal(record.Source, &parts); err != nil {
+		return
+	}
+	for _, colPath := range parts.ColPaths {
+		reachable[path.Dir(colPath)] = true
+	}
+	return
+}
+
+// marks everything a sidecar refers to reachable, whether or not its record is in elasticsearch,
+// so an empty or wrong index never costs the sidecars Reindex would rebuild it from
+func (store *LocalStorage) markSidecarsReachable(reachable map[string]bool) (err error) {
+	return store.eachSidecar(func(sidecarPath string, record elastic.ExportedRecord) error {
+		return store.markReachable(reachable, record)
+	})
+}
+
+// the size of every file under dir
+func directorySize(dir string) (size int64, err error) {
+	err = filepath.Walk(dir, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return
+}
+
+// marks a staging directory as in use so GC keeps it
+func (store *LocalStorage) beginStaging(stagingId string) {
+	store.stagingMutex.Lock()
+	defer store.stagingMutex.Unlock()
+	if store.activeStaging == nil {
+		store.activeStaging = make(map[string]bool)
+	}
+	store.activeStaging[stagingId] = true
+}
+
+func (store *LocalStorage) endStaging(stagingId string) {
+	store.stagingMutex.Lock()
+	defer store.stagingMutex.Unlock()
+	delete(store.activeStaging, stagingId)
+}
+
+// a copy of the staging directories in use
+func (store *LocalStorage) stagingInUse() (active map[string]bool) {
+	store.stagingMutex.Lock()
+	defer store.stagingMutex.Unlock()
+	active = make(map[string]bool)
+	for stagingId := range store.activeStaging {
+		active[stagingId] = true
+	}
+	return
+}
+
+// the key directories in the state directory that no record refers to, and the staging directories
+// not in active. these are left by failed ingestion, deleted records and crashes while staging.
+func (store *LocalStorage) unreachableKeyPaths(reachable map[string]bool, active map[string]bool) (garbage []GarbageEntry, err error) {
+	garbage = make([]GarbageEntry, 0)
+	stateDir := filepath.Clean(store.stateDirectory())
+	err = filepath.Walk(stateDir, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() || filePath == stateDir {
+			return nil
+		}
+		relPath, err := filepath.Rel(stateDir, filePath)
+		if err != nil {
+			return err
+		}
+		levels := strings.Split(filepath.ToSlash(relPath), "/")
+		depth := DIRECTORY_DEPTH
+		if levels[0] == STAGING_DIRECTORY {
+			depth = 2
+		} else if len(levels[0]) != HEX_CHARS_PER_DIRECTORY_LEVEL || !isHex(levels[0]) {
+			// only the hashed key tree and staging are collected, skipping elasticsearch and other directories
+			return filepath.SkipDir
+		}
+		if len(levels) < depth {
+			return nil
+		}
+		if !reachable[filePath] && !(levels[0] == STAGING_DIRECTORY && active[levels[1]]) {
+			size, err := directorySize(filePath)
+			if err != nil {
+				return err
+			}
+			garbage = append(garbage, GarbageEntry{filePath, size})
+		}
+		return filepath.SkipDir
+	})
+	return
+}
+
+func isHex(s string) bool {
+	for _, c := range s {
+		if !strings.ContainsRune("0123456789abcdef", c) {
+			return false
+		}
+	}
+	return true
+}
+
+// removes empty hashed directories from dir up to the state directory
+func (store *LocalStorage) pruneEmptyParents(dir string) {
+	stateDir := filepath.Clean(store.stateDirectory())
+	for parent := filepath.Dir(dir); parent != stateDir && strings.HasPrefix(parent, stateDir); parent = filepath.Dir(parent) {
+		// Remove fails on directories that are not empty
+		if os.Remove(parent) != nil {
+			return
+		}
+	}
+}
+
+// finds key directories unreachable from the metadata of every namespace and from the record sidecars,
+// and abandoned staging directories, and unless dryRun deletes them. only safe while no transforms are
+// executing and no data files are being added, since only the staging directories of ingestions in
+// progress are kept and not their key directories.
+func (store *LocalStorage) GC(dryRun bool) (garbage []GarbageEntry, freed int64, err error) {
+	reachable, err := store.reachableKeyPaths()
+	if err != nil {
+		return
+	}
+	garbage, err = store.unreachableKeyPaths(reachable, store.stagingInUse())
+	if err != nil {
+		return
+	}
+	for _, entry := range garbage {
+		if dryRun {
+			logger.LogInfo(LOGTAG, "GC would remove %s (%d bytes)", entry.Path, entry.Size)
+			continue
+		}
+		var removed bool
+		removed, err = store.removeGarbage(entry)
+		if err != nil {
+			return
+		}
+		if removed {
+			freed += entry.Size
+		}
+	}
+	return
+}
+
+// removes a garbage entry unless it is a staging directory an ingestion started using since it was found
+func (store *LocalStorage) removeGarbage(entry GarbageEntry) (removed bool, err error) {
+	stagingDir := filepath.Clean(store.absoluteStoragePath(STAGING_DIRECTORY))
+	if filepath.Dir(entry.Path) == stagingDir {
+		// held while removing so the staging directory cannot be registered and removed at once
+		store.stagingMutex.Lock()
+		defer store.stagingMutex.Unlock()
+		if store.activeStaging[filepath.Base(entry.Path)] {
+			logger.LogInfo(LOGTAG, "GC keeping %s, it is in use", entry.Path)
+			return
+		}
+	}
+	logger.LogInfo(LOGTAG, "GC removing %s (%d bytes)", entry.Path, entry.Size)
+	err = os.RemoveAll(entry.Path)
+	if err != nil {
+		return
+	}
+	store.pruneEmptyParents(entry.Path)
+	return true, nil
+}
@@ -0,0 +1,99 @@
+package local
+
+import (
+	"encoding/json"
+	"github.com/ProtoML/ProtoML-persist/persist"
+	"github.com/ProtoML/ProtoML-persist/persist/elastic"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeTestFile(t *testing.T, filePath string, content string) {
+	if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+		t.Fatalf("creating %s: %s", filepath.Dir(filePath), err)
+	}
+	if err := ioutil.WriteFile(filePath, []byte(content), 0644); err != nil {
+		t.Fatalf("writing %s: %s", filePath, err)
+	}
+}
+
+func TestUnreachableKeyPaths(t *testing.T) {
+	rootDir, err := ioutil.TempDir("", "protoml-gc")
+	if err != nil {
+		t.Fatalf("creating temp dir: %s", err)
+	}
+	defer os.RemoveAll(rootDir)
+	store := &LocalStorage{Config: persist.Config{LocalPersistStorage: persist.LocalPersistStorageConfig{RootDir: rootDir}}}
+	stateDir := filepath.Clean(store.stateDirectory())
+
+	reachableDir := filepath.Join(stateDir, "aaaa", "bbbb", "cccc", "dddd")
+	unreachableDir := filepath.Join(stateDir, "1111", "2222", "3333", "4444")
+	activeStaging := filepath.Join(stateDir, STAGING_DIRECTORY, "active")
+	abandonedStaging := filepath.Join(stateDir, STAGING_DIRECTORY, "abandoned")
+	writeTestFile(t, filepath.Join(reachableDir, "col0"), "1,2,3")
+	writeTestFile(t, filepath.Join(unreachableDir, "col0"), "4,5,6")
+	writeTestFile(t, filepath.Join(unreachableDir, "col1"), "7")
+	writeTestFile(t, filepath.Join(activeStaging, "col0"), "8,9")
+	writeTestFile(t, filepath.Join(abandonedStaging, "col0"), "10")
+	// directories outside the key tree and staging are never collected
+	writeTestFile(t, filepath.Join(stateDir, ELASTIC_DIRECTORY, "nodes", "0"), "index")
+	writeTestFile(t, filepath.Join(stateDir, "notes", "readme"), "kept")
+
+	garbage, err := store.unreachableKeyPaths(map[string]bool{reachableDir: true}, map[string]bool{"active": true})
+	if err != nil {
+		t.Fatalf("unreachableKeyPaths returned error: %s", err)
+	}
+	want := map[string]int64{unreachableDir: 6, abandonedStaging: 2}
+	if len(garbage) != len(want) {
+		t.Fatalf("unreachableKeyPaths = %v, want %v", garbage, want)
+	}
+	for _, entry := range garbage {
+		if size, ok := want[entry.Path]; !ok || size != entry.Size {
+			t.Errorf("unreachableKeyPaths returned %v, want %v", entry, want)
+		}
+	}
+}
+
+func writeTestSidecar(t *testing.T, store *LocalStorage, record elastic.ExportedRecord) {
+	blob, err := json.Marshal(record)
+	if err != nil {
+		t.Fatalf("encoding sidecar: %s", err)
+	}
+	writeTestFile(t, store.sidecarPath(record.Namespace, record.Type, record.Id), string(blob))
+}
+
+func TestSidecarsKeepKeyPathsWithoutIndex(t *testing.T) {
+	rootDir, err := ioutil.TempDir("", "protoml-gc")
+	if err != nil {
+		t.Fatalf("creating temp dir: %s", err)
+	}
+	defer os.RemoveAll(rootDir)
+	store := &LocalStorage{Config: persist.Config{LocalPersistStorage: persist.LocalPersistStorageConfig{RootDir: rootDir}}}
+
+	// the index is empty, only the sidecars know about these records
+	dataDir := store.getKeyPath(DataKey("dg1"))
+	colPath := filepath.Join(dataDir, "0000000000.csv")
+	writeTestFile(t, colPath, "1")
+	parts, err := json.Marshal(dataGroupParts{ColPaths: []string{colPath}})
+	if err != nil {
+		t.Fatalf("encoding dataparts: %s", err)
+	}
+	writeTestSidecar(t, store, elastic.ExportedRecord{Type: elastic.DATAPARTS_TYPE, Id: "dp1", Source: parts})
+	writeTestSidecar(t, store, elastic.ExportedRecord{Namespace: "other", Type: elastic.DATAGROUP_TYPE, Id: "dg1", Source: json.RawMessage(`{}`)})
+	orphanDir := store.getKeyPath(DataKey("orphan"))
+	writeTestFile(t, filepath.Join(orphanDir, "0000000000.csv"), "2")
+
+	reachable := make(map[string]bool)
+	if err = store.markSidecarsReachable(reachable); err != nil {
+		t.Fatalf("markSidecarsReachable returned error: %s", err)
+	}
+	garbage, err := store.unreachableKeyPaths(reachable, nil)
+	if err != nil {
+		t.Fatalf("unreachableKeyPaths returned error: %s", err)
+	}
+	if len(garbage) != 1 || garbage[0].Path != filepath.Clean(orphanDir) {
+		t.Errorf("unreachableKeyPaths with sidecars only = %v, want only %s", garbage, orphanDir)
+	}
+}
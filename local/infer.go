@@ -0,0 +1,167 @@
+package local
+
+import (
+	"bufio"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"github.com/ProtoML/ProtoML-persist/persist/elastic"
+	"github.com/ProtoML/ProtoML-persist/persist/persistparsers"
+	"github.com/ProtoML/ProtoML/logger"
+	"github.com/ProtoML/ProtoML/types"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+const INFERRED_TAG = "inferred"
+
+// values telling the well known recognizers apart, a recognizer accepting fewer is narrower
+var inferenceProbes = []string{"0", "1", "-7", "2.5", "word"}
+
+// a registered datatype whose values can be recognized
+type inferenceCandidate struct {
+	name      types.DataTypeName
+	parser    func(value string) bool
+	breadth   int
+	ancestors int
+}
+
+// registered datatypes with a recognizer, narrowest first. Datatypes accepting the same values
+// are ordered base types first, since a subtype recognized by its ancestor's parser is a choice
+// for the user to make rather than something the values show.
+func inferenceCandidates() (candidates []inferenceCandidate, err error) {
+	candidates = make([]inferenceCandidate, 0)
+	err = elastic.EachDataType(func(id string, datatype types.DataType) error {
+		ancestors, err := elastic.GetDataTypeAncestors(datatype.TypeName)
+		if err != nil {
+			return err
+		}
+		parser, ok := persistparsers.DataTypeValueParser(datatype.TypeName, ancestors)
+		if !ok {
+			return nil
+		}
+		candidates = append(candidates, newInferenceCandidate(datatype.TypeName, parser, len(ancestors)))
+		return nil
+	})
+	sortInferenceCandidates(candidates)
+	return
+}
+
+func newInferenceCandidate(name types.DataTypeName, parser func(value string) bool, ancestors int) inferenceCandidate {
+	breadth := 0
+	for _, probe := range inferenceProbes {
+		if parser(probe) {
+			breadth++
+		}
+	}
+	return inferenceCandidate{name, parser, breadth, ancestors}
+}
+
+func sortInferenceCandidates(candidates []inferenceCandidate) {
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].breadth != candidates[j].breadth {
+			return candidates[i].breadth < candidates[j].breadth
+		}
+		if candidates[i].ancestors != candidates[j].ancestors {
+			return candidates[i].ancestors < candidates[j].ancestors
+		}
+		return candidates[i].name < candidates[j].name
+	})
+}
+
+// scans a dataset file to count its rows and columns and guess each column's datatype from the
+// registered datatypes. Every column is tagged INFERRED_TAG. The result is meant to be reviewed
+// before it is given to AddDataFile.
+func (store *LocalStorage) InferDatasetFile(datasetPath, format string) (dataFile types.DatasetFile, err error) {
+	if !strings.EqualFold(format, CSV_FORMAT) {
+		err = errors.New(fmt.Sprintf("Can't infer the schema of %s files", format))
+		return
+	}
+	candidates, err := inferenceCandidates()
+	if err != nil {
+		return
+	}
+	return inferDatasetFile(datasetPath, format, candidates)
+}
+
+// infers a dataset file schema choosing among candidates, ordered as by sortInferenceCandidates
+func inferDatasetFile(datasetPath, format string, candidates []inferenceCandidate) (dataFile types.DatasetFile, err error) {
+	if len(candidates) == 0 {
+		err = errors.New("No registered datatype has a value recognizer")
+		return
+	}
+	input, err := os.Open(datasetPath)
+	if err != nil {
+		return
+	}
+	defer input.Close()
+	logger.LogDebug(LOGTAG, "Inferring schema of %s from %d datatypes", datasetPath, len(candidates))
+
+	// rejected[col][i] is set once a value of col is not recognized by candidates[i]
+	var rejected [][]bool
+	var seen []bool
+	reader := csv.NewReader(bufio.NewReader(input))
+	reader.ReuseRecord = true
+	rows := 0
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return dataFile, errors.New(fmt.Sprintf("Can't read %s: %s", datasetPath, err))
+		}
+		if rejected == nil {
+			rejected = make([][]bool, len(record))
+			seen = make([]bool, len(record))
+			for col := range rejected {
+				rejected[col] = make([]bool, len(candidates))
+			}
+		}
+		for col, value := range record {
+			// empty values are missing, not evidence of a type
+			if len(strings.TrimSpace(value)) == 0 {
+				continue
+			}
+			seen[col] = true
+			for i, candidate := range candidates {
+				if !rejected[col][i] && !candidate.parser(value) {
+					rejected[col][i] = true
+				}
+			}
+		}
+		rows++
+	}
+	if rows == 0 {
+		err = errors.New(fmt.Sprintf("Dataset file %s is empty", datasetPath))
+		return
+	}
+
+	dataFile = types.DatasetFile{Path: datasetPath, FileFormat: format, NRows: rows, NCols: len(rejected)}
+	dataFile.Columns.ExclusiveTypes = make(map[types.DataTypeName][]int)
+	dataFile.Columns.Tags = map[string][]int{INFERRED_TAG: make([]int, 0, len(rejected))}
+	for col := range rejected {
+		// columns without values get the broadest datatype
+		guess := -1
+		if seen[col] {
+			for i := range candidates {
+				if !rejected[col][i] {
+					guess = i
+					break
+				}
+			}
+		} else {
+			guess = len(candidates) - 1
+		}
+		if guess < 0 {
+			err = errors.New(fmt.Sprintf("No registered datatype recognizes every value of column %d of %s", col, datasetPath))
+			return
+		}
+		typename := candidates[guess].name
+		dataFile.Columns.ExclusiveTypes[typename] = append(dataFile.Columns.ExclusiveTypes[typename], col)
+		dataFile.Columns.Tags[INFERRED_TAG] = append(dataFile.Columns.Tags[INFERRED_TAG], col)
+	}
+	return
+}
@@ -0,0 +1,69 @@
+package local
+
+import (
+	"github.com/ProtoML/ProtoML-persist/persist/persistparsers"
+	"github.com/ProtoML/ProtoML/types"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func testInferenceCandidates() []inferenceCandidate {
+	parsers := persistparsers.DataTypeValueParsers
+	candidates := []inferenceCandidate{
+		newInferenceCandidate("string", parsers["string"], 0),
+		newInferenceCandidate("real", parsers["real"], 0),
+		// a user subtype of real accepts the same values as real
+		newInferenceCandidate("price", parsers["real"], 1),
+		newInferenceCandidate("integer", parsers["integer"], 1),
+		newInferenceCandidate("binary", parsers["binary"], 2),
+	}
+	sortInferenceCandidates(candidates)
+	return candidates
+}
+
+func TestSortInferenceCandidates(t *testing.T) {
+	candidates := testInferenceCandidates()
+	want := []types.DataTypeName{"binary", "integer", "real", "price", "string"}
+	for i, name := range want {
+		if candidates[i].name != name {
+			t.Errorf("sorted candidate %d = %s, want %s", i, candidates[i].name, name)
+		}
+	}
+}
+
+func TestInferDatasetFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "protoml-infer")
+	if err != nil {
+		t.Fatalf("creating temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	datasetPath := filepath.Join(dir, "data.csv")
+	writeTestFile(t, datasetPath, "0,4,2.5,red,\n1,-7,3,blue,\n1,12,,green,\n")
+
+	dataFile, err := inferDatasetFile(datasetPath, CSV_FORMAT, testInferenceCandidates())
+	if err != nil {
+		t.Fatalf("inferDatasetFile returned error: %s", err)
+	}
+	if dataFile.NRows != 3 || dataFile.NCols != 5 {
+		t.Errorf("inferDatasetFile shape = %d rows %d cols, want 3 rows 5 cols", dataFile.NRows, dataFile.NCols)
+	}
+	// columns without values get the broadest datatype
+	want := map[types.DataTypeName][]int{"binary": {0}, "integer": {1}, "real": {2}, "string": {3, 4}}
+	for name, cols := range want {
+		got := dataFile.Columns.ExclusiveTypes[name]
+		if len(got) != len(cols) {
+			t.Errorf("inferred %s columns = %v, want %v", name, got, cols)
+			continue
+		}
+		for i := range cols {
+			if got[i] != cols[i] {
+				t.Errorf("inferred %s columns = %v, want %v", name, got, cols)
+			}
+		}
+	}
+	if len(dataFile.Columns.Tags[INFERRED_TAG]) != 5 {
+		t.Errorf("inferred columns tagged %v, want every column", dataFile.Columns.Tags[INFERRED_TAG])
+	}
+}
@@ -0,0 +1,380 @@
+package local
+
+import (
+	"bufio"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"github.com/ProtoML/ProtoML-persist/persist"
+	"github.com/ProtoML/ProtoML-persist/persist/elastic"
+	"github.com/ProtoML/ProtoML-persist/persist/persistparsers"
+	"github.com/ProtoML/ProtoML/logger"
+	"github.com/ProtoML/ProtoML/types"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+const (
+	CSV_FORMAT            = "csv"
+	DEFAULT_MEMORY_BUDGET = 64 << 20
+	MIN_COLUMN_BUFFER     = 4 << 10
+	INGEST_CHUNK_ROWS     = 10000
+	// columns written per pass over the input, bounding open files
+	MAX_OPEN_COLUMNS = 256
+)
+
+// counts the bytes read from the input for progress reports
+type countingReader struct {
+	reader io.Reader
+	count  int64
+}
+
+func (counter *countingReader) Read(p []byte) (n int, err error) {
+	n, err = counter.reader.Read(p)
+	counter.count += int64(n)
+	return
+}
+
+// a column file written through a fixed size buffer
+type columnWriter struct {
+	file   *os.File
+	buffer *bufio.Writer
+	csv    *csv.Writer
+}
+
+// writes a value as a row of the column file. encoding/csv writes an empty value as an empty
+// line, which readers skip, so it is written quoted to keep the rows of the column aligned.
+func (column *columnWriter) write(value string) (err error) {
+	if len(value) > 0 {
+		return column.csv.Write([]string{value})
+	}
+	column.csv.Flush()
+	if err = column.csv.Error(); err != nil {
+		return
+	}
+	_, err = column.buffer.WriteString("\"\"\n")
+	return
+}
+
+func (column *columnWriter) close() (err error) {
+	column.csv.Flush()
+	err = column.csv.Error()
+	if closeErr := column.file.Close(); err == nil {
+		err = closeErr
+	}
+	return
+}
+
+func memoryBudget(options persist.IngestOptions) int {
+	if options.MemoryBudget > 0 {
+		return options.MemoryBudget
+	}
+	return DEFAULT_MEMORY_BUDGET
+}
+
+func reportProgress(options persist.IngestOptions, progress persist.IngestProgress) {
+	if options.Progress != nil {
+		options.Progress(progress)
+	}
+}
+
+// splits a dataset file into column files in dir, streaming formats it can read itself
+// and handing the rest to the format adaptors. csv files never reach FormatCollection.Split,
+// so a csv adaptor registered in the collection is not used for ingestion.
+func (store *LocalStorage) splitDataFile(dataFile types.DatasetFile, dir string, options persist.IngestOptions) (dataGroups []types.DataGroup, colPaths []string, groupToCols [][]int, err error) {
+	if strings.EqualFold(dataFile.FileFormat, CSV_FORMAT) {
+		return streamSplitCSV(dataFile, dir, options)
+	}
+	dataGroups, colPaths, groupToCols, err = store.FormatCollection.Split(dataFile, dir)
+	if err != nil {
+		return
+	}
+	err = verifySplitColumns(dataFile, dataGroups, colPaths, groupToCols)
+	if err != nil {
+		return
+	}
+	progress := persist.IngestProgress{Path: dataFile.Path, Rows: dataFile.NRows}
+	if info, statErr := os.Stat(dataFile.Path); statErr == nil {
+		progress.BytesRead = info.Size()
+		progress.TotalBytes = info.Size()
+	}
+	reportProgress(options, progress)
+	return
+}
+
+// checks the column files split by a format adaptor against the declared shape and column datatypes
+// of the dataset file. every column must be split exactly once, into a column file that can be read
+// back, which is the case for csv column files only.
+func verifySplitColumns(dataFile types.DatasetFile, dataGroups []types.DataGroup, colPaths []string, groupToCols [][]int) (err error) {
+	colTypes, parsers, err := columnValueParsers(dataFile)
+	if err != nil {
+		return
+	}
+	return verifyColumnFiles(dataFile, dataGroups, colPaths, groupToCols, colTypes, parsers)
+}
+
+// checks with the datatypes and value recognizers of the columns already looked up
+func verifyColumnFiles(dataFile types.DatasetFile, dataGroups []types.DataGroup, colPaths []string, groupToCols [][]int, colTypes []types.DataTypeName, parsers []func(value string) bool) (err error) {
+	if len(colPaths) != dataFile.NCols || len(groupToCols) != len(dataGroups) {
+		return errors.New(fmt.Sprintf("Splitting %s gave %d column files in %d datagroups, want %d columns", dataFile.Path, len(colPaths), len(dataGroups), dataFile.NCols))
+	}
+	split := make([]bool, dataFile.NCols)
+	for _, cols := range groupToCols {
+		for _, col := range cols {
+			if col < 0 || col >= dataFile.NCols || split[col] {
+				return errors.New(fmt.Sprintf("Splitting %s gave column %d more than once or out of range", dataFile.Path, col))
+			}
+			split[col] = true
+		}
+	}
+	for col, ok := range split {
+		if !ok {
+			return errors.New(fmt.Sprintf("Splitting %s did not give column %d", dataFile.Path, col))
+		}
+	}
+
+	report := persist.NewDatasetReport(dataFile)
+	report.Rows = dataFile.NRows
+	for i, dataGroup := range dataGroups {
+		if !strings.EqualFold(dataGroup.FileFormat, CSV_FORMAT) {
+			return errors.New(fmt.Sprintf("Values of %s can't be verified, its columns are split into format %s", dataFile.Path, dataGroup.FileFormat))
+		}
+		for _, col := range groupToCols[i] {
+			rows, err := checkColumnFile(colPaths[col], col, colTypes[col], parsers[col], report)
+			if err != nil {
+				return err
+			}
+			if rows != dataFile.NRows {
+				report.Rows = rows
+			}
+		}
+	}
+	if !report.OK() {
+		return report
+	}
+	return
+}
+
+// reads back a single column csv file, checking its values into report, and counts its rows
+func checkColumnFile(colPath string, col int, colType types.DataTypeName, parser func(value string) bool, report *persist.DatasetReport) (rows int, err error) {
+	file, err := os.Open(colPath)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	reader := csv.NewReader(bufio.NewReader(file))
+	reader.FieldsPerRecord = 1
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return rows, errors.New(fmt.Sprintf("Can't read column file %s: %s", colPath, err))
+		}
+		// empty values are missing
+		if parser != nil && len(strings.TrimSpace(record[0])) > 0 && !parser(record[0]) {
+			report.AddBadValue(persist.BadDatasetValue{Row: rows, Column: col, DataType: colType, Value: record[0]})
+		}
+		rows++
+	}
+	return
+}
+
+// the datatype of every column and its value recognizer, nil when the datatype has none
+func columnValueParsers(dataFile types.DatasetFile) (colTypes []types.DataTypeName, parsers []func(value string) bool, err error) {
+	colTypes = make([]types.DataTypeName, dataFile.NCols)
+	parsers = make([]func(value string) bool, dataFile.NCols)
+	for typename, indices := range dataFile.Columns.ExclusiveTypes {
+		ancestors, err := elastic.GetDataTypeAncestors(typename)
+		if err != nil {
+			return colTypes, parsers, err
+		}
+		parser, ok := persistparsers.DataTypeValueParser(typename, ancestors)
+		if !ok {
+			logger.LogDebug(LOGTAG, "Values of datatype %s in %s can't be verified", typename, dataFile.Path)
+		}
+		for _, index := range indices {
+			if index >= 0 && index < dataFile.NCols {
+				colTypes[index] = typename
+				parsers[index] = parser
+			}
+		}
+	}
+	return
+}
+
+// the number of columns written per pass over the input and the size of each buffer,
+// so the open column files and the buffers of a pass stay within the memory budget
+func columnBatching(nCols int, options persist.IngestOptions) (batchSize int, bufferSize int) {
+	budget := memoryBudget(options)
+	batchSize = budget/MIN_COLUMN_BUFFER - 1
+	if batchSize > MAX_OPEN_COLUMNS {
+		batchSize = MAX_OPEN_COLUMNS
+	}
+	if batchSize > nCols {
+		batchSize = nCols
+	}
+	if batchSize < 1 {
+		batchSize = 1
+	}
+	// the budget is shared by the input buffer and the column buffers of a pass
+	bufferSize = budget / (batchSize + 1)
+	if bufferSize < MIN_COLUMN_BUFFER {
+		bufferSize = MIN_COLUMN_BUFFER
+	}
+	return
+}
+
+// splits a csv dataset file row chunk by row chunk into one file per column, grouping columns
+// by exclusive type. Wide files are read once per batch of columns, so only one row, the open
+// column files of a batch and their buffers, sized from the memory budget, are held at once and
+// files of any size and width can be split. The whole file is checked against its declared
+// shape and column datatypes, a *persist.DatasetReport is returned when it does not match.
+func streamSplitCSV(dataFile types.DatasetFile, dir string, options persist.IngestOptions) (dataGroups []types.DataGroup, colPaths []string, groupToCols [][]int, err error) {
+	colTypes, parsers, err := columnValueParsers(dataFile)
+	if err != nil {
+		return
+	}
+	return splitCSVFile(dataFile, dir, colTypes, parsers, options)
+}
+
+// splits with the datatypes and value recognizers of the columns already looked up
+func splitCSVFile(dataFile types.DatasetFile, dir string, colTypes []types.DataTypeName, parsers []func(value string) bool, options persist.IngestOptions) (dataGroups []types.DataGroup, colPaths []string, groupToCols [][]int, err error) {
+	info, err := os.Stat(dataFile.Path)
+	if err != nil {
+		return
+	}
+	batchSize, bufferSize := columnBatching(dataFile.NCols, options)
+	passes := (dataFile.NCols + batchSize - 1) / batchSize
+	if passes < 1 {
+		passes = 1
+	}
+	logger.LogDebug(LOGTAG, "Streaming %s into %d columns in %d passes with %d byte buffers", dataFile.Path, dataFile.NCols, passes, bufferSize)
+
+	report := persist.NewDatasetReport(dataFile)
+	colPaths = make([]string, dataFile.NCols)
+	for col := range colPaths {
+		colPaths[col] = path.Join(dir, fmt.Sprintf("%010d.%s", col, dataFile.FileFormat))
+	}
+
+	rows := 0
+	for pass := 0; pass < passes; pass++ {
+		first := pass * batchSize
+		last := first + batchSize
+		if last > dataFile.NCols {
+			last = dataFile.NCols
+		}
+		progress := persist.IngestProgress{Path: dataFile.Path, BytesRead: int64(pass) * info.Size(), TotalBytes: int64(passes) * info.Size()}
+		passRows, err := splitCSVColumns(dataFile, colPaths, colTypes, parsers, first, last, bufferSize, report, pass == 0, options, progress)
+		if err != nil {
+			return dataGroups, colPaths, groupToCols, err
+		}
+		if pass == 0 {
+			rows = passRows
+		} else if passRows != rows {
+			return dataGroups, colPaths, groupToCols, errors.New(fmt.Sprintf("%s changed while it was read, %d rows became %d", dataFile.Path, rows, passRows))
+		}
+	}
+
+	report.Rows = rows
+	if !report.OK() {
+		err = report
+		return
+	}
+
+	// one datagroup per exclusive type
+	typeNames := make([]string, 0, len(dataFile.Columns.ExclusiveTypes))
+	for typename := range dataFile.Columns.ExclusiveTypes {
+		typeNames = append(typeNames, string(typename))
+	}
+	sort.Strings(typeNames)
+	dataGroups = make([]types.DataGroup, len(typeNames))
+	groupToCols = make([][]int, len(typeNames))
+	for i, typename := range typeNames {
+		cols := append([]int{}, dataFile.Columns.ExclusiveTypes[types.DataTypeName(typename)]...)
+		sort.Ints(cols)
+		groupToCols[i] = cols
+		dataGroups[i].Columns.ExclusiveType = types.DataTypeName(typename)
+		dataGroups[i].NCols = len(cols)
+		dataGroups[i].NRows = rows
+		dataGroups[i].FileFormat = dataFile.FileFormat
+		dataGroups[i].Source = dataFile.Path
+	}
+	reportProgress(options, persist.IngestProgress{Path: dataFile.Path, BytesRead: int64(passes) * info.Size(), TotalBytes: int64(passes) * info.Size(), Rows: rows})
+	return
+}
+
+// reads the whole csv input once, writing the columns from first up to last into their column files
+// and checking their values into report. rows of the wrong shape are skipped, and reported when
+// checkShape is set. progress carries the bytes read by earlier passes.
+func splitCSVColumns(dataFile types.DatasetFile, colPaths []string, colTypes []types.DataTypeName, parsers []func(value string) bool, first, last int, bufferSize int, report *persist.DatasetReport, checkShape bool, options persist.IngestOptions, progress persist.IngestProgress) (rows int, err error) {
+	input, err := os.Open(dataFile.Path)
+	if err != nil {
+		return
+	}
+	defer input.Close()
+
+	columns := make([]*columnWriter, last-first)
+	defer func() {
+		for _, column := range columns {
+			if column == nil {
+				continue
+			}
+			if closeErr := column.close(); err == nil {
+				err = closeErr
+			}
+		}
+	}()
+	for i := range columns {
+		file, err := os.Create(colPaths[first+i])
+		if err != nil {
+			return rows, err
+		}
+		buffer := bufio.NewWriterSize(file, bufferSize)
+		columns[i] = &columnWriter{file, buffer, csv.NewWriter(buffer)}
+	}
+
+	counter := &countingReader{reader: input}
+	reader := csv.NewReader(bufio.NewReaderSize(counter, bufferSize))
+	// rows of the wrong shape are reported rather than failing the read
+	reader.FieldsPerRecord = -1
+	reader.ReuseRecord = true
+	startBytes := progress.BytesRead
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return rows, errors.New(fmt.Sprintf("Can't read %s: %s", dataFile.Path, err))
+		}
+		if len(record) != dataFile.NCols {
+			if checkShape {
+				report.AddBadShapeRow(rows, len(record))
+			}
+			rows++
+			continue
+		}
+		for col := first; col < last; col++ {
+			value := record[col]
+			// empty values are missing
+			if parsers[col] != nil && len(strings.TrimSpace(value)) > 0 && !parsers[col](value) {
+				report.AddBadValue(persist.BadDatasetValue{Row: rows, Column: col, DataType: colTypes[col], Value: value})
+			}
+			if err = columns[col-first].write(value); err != nil {
+				return rows, err
+			}
+		}
+		rows++
+		if rows%INGEST_CHUNK_ROWS == 0 {
+			progress.BytesRead = startBytes + counter.count
+			progress.Rows = rows
+			reportProgress(options, progress)
+		}
+	}
+	return
+}
@@ -0,0 +1,241 @@
+package local
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"github.com/ProtoML/ProtoML-persist/persist"
+	"github.com/ProtoML/ProtoML-persist/persist/persistparsers"
+	"github.com/ProtoML/ProtoML/types"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// the value parsers of the default datatypes, as columnValueParsers gives them without elasticsearch
+func testColumnParsers(dataFile types.DatasetFile) (colTypes []types.DataTypeName, parsers []func(value string) bool) {
+	colTypes = make([]types.DataTypeName, dataFile.NCols)
+	parsers = make([]func(value string) bool, dataFile.NCols)
+	for typename, indices := range dataFile.Columns.ExclusiveTypes {
+		for _, index := range indices {
+			colTypes[index] = typename
+			parsers[index] = persistparsers.DataTypeValueParsers[typename]
+		}
+	}
+	return
+}
+
+func testDatasetFile(t *testing.T, dir string, content string, nRows int, exclusiveTypes map[types.DataTypeName][]int) types.DatasetFile {
+	datasetPath := filepath.Join(dir, "data.csv")
+	writeTestFile(t, datasetPath, content)
+	nCols := 0
+	for _, cols := range exclusiveTypes {
+		nCols += len(cols)
+	}
+	return types.DatasetFile{
+		Path:       datasetPath,
+		FileFormat: CSV_FORMAT,
+		NRows:      nRows,
+		NCols:      nCols,
+		Columns:    types.DatasetColumns{ExclusiveTypes: exclusiveTypes},
+	}
+}
+
+func readTestColumn(t *testing.T, colPath string) []string {
+	file, err := os.Open(colPath)
+	if err != nil {
+		t.Fatalf("opening column file: %s", err)
+	}
+	defer file.Close()
+	records, err := csv.NewReader(file).ReadAll()
+	if err != nil {
+		t.Fatalf("reading column file %s: %s", colPath, err)
+	}
+	values := make([]string, len(records))
+	for i, record := range records {
+		values[i] = record[0]
+	}
+	return values
+}
+
+func TestColumnBatching(t *testing.T) {
+	tests := []struct {
+		nCols        int
+		memoryBudget int
+		batchSize    int
+		bufferSize   int
+	}{
+		{3, 0, 3, DEFAULT_MEMORY_BUDGET / 4},
+		{1000, 0, MAX_OPEN_COLUMNS, DEFAULT_MEMORY_BUDGET / (MAX_OPEN_COLUMNS + 1)},
+		{5, 2 * MIN_COLUMN_BUFFER, 1, MIN_COLUMN_BUFFER},
+		// budgets too small for a single column still split one column per pass
+		{5, 1, 1, MIN_COLUMN_BUFFER},
+		{0, 0, 1, DEFAULT_MEMORY_BUDGET / 2},
+	}
+	for _, test := range tests {
+		batchSize, bufferSize := columnBatching(test.nCols, persist.IngestOptions{MemoryBudget: test.memoryBudget})
+		if batchSize != test.batchSize || bufferSize != test.bufferSize {
+			t.Errorf("columnBatching(%d, %d) = %d, %d, want %d, %d", test.nCols, test.memoryBudget, batchSize, bufferSize, test.batchSize, test.bufferSize)
+		}
+	}
+}
+
+func TestColumnWriterKeepsEmptyValues(t *testing.T) {
+	dir, err := ioutil.TempDir("", "protoml-ingest")
+	if err != nil {
+		t.Fatalf("creating temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	colPath := filepath.Join(dir, "col.csv")
+	file, err := os.Create(colPath)
+	if err != nil {
+		t.Fatalf("creating column file: %s", err)
+	}
+	buffer := bufio.NewWriter(file)
+	column := &columnWriter{file, buffer, csv.NewWriter(buffer)}
+	values := []string{"a", "", "b,c", ""}
+	for _, value := range values {
+		if err = column.write(value); err != nil {
+			t.Fatalf("write(%q) returned error: %s", value, err)
+		}
+	}
+	if err = column.close(); err != nil {
+		t.Fatalf("close returned error: %s", err)
+	}
+
+	got := readTestColumn(t, colPath)
+	if strings.Join(got, "|") != strings.Join(values, "|") || len(got) != len(values) {
+		t.Errorf("column written from %q reads back as %q", values, got)
+	}
+}
+
+func TestSplitCSVFileInPasses(t *testing.T) {
+	dir, err := ioutil.TempDir("", "protoml-ingest")
+	if err != nil {
+		t.Fatalf("creating temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	dataFile := testDatasetFile(t, dir, "1,a,4\n,b,\n3,,6\n,,\n", 4, map[types.DataTypeName][]int{"integer": {0, 2}, "string": {1}})
+	colTypes, parsers := testColumnParsers(dataFile)
+
+	// one column per pass, so every column is written by another pass over the input
+	options := persist.IngestOptions{MemoryBudget: 2 * MIN_COLUMN_BUFFER}
+	dataGroups, colPaths, groupToCols, err := splitCSVFile(dataFile, dir, colTypes, parsers, options)
+	if err != nil {
+		t.Fatalf("splitCSVFile returned error: %s", err)
+	}
+	want := [][]string{{"1", "", "3", ""}, {"a", "b", "", ""}, {"4", "", "6", ""}}
+	for col, values := range want {
+		got := readTestColumn(t, colPaths[col])
+		if fmt.Sprintf("%q", got) != fmt.Sprintf("%q", values) {
+			t.Errorf("column %d = %q, want %q", col, got, values)
+		}
+	}
+	if len(dataGroups) != 2 || dataGroups[0].Columns.ExclusiveType != "integer" || dataGroups[0].NRows != 4 {
+		t.Errorf("splitCSVFile datagroups = %v, want integer and string datagroups of 4 rows", dataGroups)
+	}
+	if fmt.Sprint(groupToCols) != "[[0 2] [1]]" {
+		t.Errorf("splitCSVFile groupToCols = %v, want [[0 2] [1]]", groupToCols)
+	}
+	if err = verifyColumnFiles(dataFile, dataGroups, colPaths, groupToCols, colTypes, parsers); err != nil {
+		t.Errorf("verifyColumnFiles of the split columns returned error: %s", err)
+	}
+}
+
+func TestSplitCSVFileReportsBadRows(t *testing.T) {
+	dir, err := ioutil.TempDir("", "protoml-ingest")
+	if err != nil {
+		t.Fatalf("creating temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	dataFile := testDatasetFile(t, dir, "1,a\n2\n3,b,c\nx,d\n", 4, map[types.DataTypeName][]int{"integer": {0}, "string": {1}})
+	colTypes, parsers := testColumnParsers(dataFile)
+
+	_, _, _, err = splitCSVFile(dataFile, dir, colTypes, parsers, persist.IngestOptions{MemoryBudget: 2 * MIN_COLUMN_BUFFER})
+	report, ok := err.(*persist.DatasetReport)
+	if !ok {
+		t.Fatalf("splitCSVFile error = %v, want a *persist.DatasetReport", err)
+	}
+	if report.Rows != 4 || report.BadShapeRowCount != 2 || report.BadShapeRows[1] != 1 || report.BadShapeRows[2] != 3 {
+		t.Errorf("splitCSVFile report = %+v, want 4 rows with rows 1 and 2 of the wrong shape", report)
+	}
+	if report.BadValueCount != 1 || report.BadValues[0].Row != 3 || report.BadValues[0].Value != "x" {
+		t.Errorf("splitCSVFile bad values = %+v, want x at row 3", report.BadValues)
+	}
+}
+
+func TestSplitCSVFileDetectsChangedFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "protoml-ingest")
+	if err != nil {
+		t.Fatalf("creating temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	rows := 2 * INGEST_CHUNK_ROWS
+	dataFile := testDatasetFile(t, dir, strings.Repeat("1,2\n", rows), rows, map[types.DataTypeName][]int{"integer": {0, 1}})
+	colTypes, parsers := testColumnParsers(dataFile)
+	info, err := os.Stat(dataFile.Path)
+	if err != nil {
+		t.Fatalf("stat %s: %s", dataFile.Path, err)
+	}
+
+	// rows are appended once the second pass reports progress
+	appended := false
+	options := persist.IngestOptions{MemoryBudget: 2 * MIN_COLUMN_BUFFER, Progress: func(progress persist.IngestProgress) {
+		if appended || progress.BytesRead <= info.Size() {
+			return
+		}
+		appended = true
+		file, err := os.OpenFile(dataFile.Path, os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			t.Fatalf("opening %s: %s", dataFile.Path, err)
+		}
+		defer file.Close()
+		if _, err = file.WriteString("3,4\n"); err != nil {
+			t.Fatalf("appending to %s: %s", dataFile.Path, err)
+		}
+	}}
+	_, _, _, err = splitCSVFile(dataFile, dir, colTypes, parsers, options)
+	if !appended {
+		t.Fatalf("the second pass never reported progress")
+	}
+	if err == nil || !strings.Contains(err.Error(), "changed while it was read") {
+		t.Errorf("splitCSVFile of a file changed between passes = %v, want a changed file error", err)
+	}
+}
+
+func TestVerifyColumnFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "protoml-ingest")
+	if err != nil {
+		t.Fatalf("creating temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	dataFile := testDatasetFile(t, dir, "", 2, map[types.DataTypeName][]int{"integer": {0}, "string": {1}})
+	colTypes, parsers := testColumnParsers(dataFile)
+	colPaths := []string{filepath.Join(dir, "0.csv"), filepath.Join(dir, "1.csv")}
+	writeTestFile(t, colPaths[0], "1\n\"\"\n")
+	writeTestFile(t, colPaths[1], "a\nb\n")
+	dataGroups := []types.DataGroup{{FileFormat: CSV_FORMAT}, {FileFormat: CSV_FORMAT}}
+	groupToCols := [][]int{{0}, {1}}
+
+	if err = verifyColumnFiles(dataFile, dataGroups, colPaths, groupToCols, colTypes, parsers); err != nil {
+		t.Errorf("verifyColumnFiles returned error: %s", err)
+	}
+	if err = verifyColumnFiles(dataFile, dataGroups, colPaths, [][]int{{0}, {0}}, colTypes, parsers); err == nil {
+		t.Errorf("verifyColumnFiles with a column split twice returned no error")
+	}
+	if err = verifyColumnFiles(dataFile, []types.DataGroup{{FileFormat: "json"}, dataGroups[1]}, colPaths, groupToCols, colTypes, parsers); err == nil {
+		t.Errorf("verifyColumnFiles of a json column file returned no error")
+	}
+
+	writeTestFile(t, colPaths[0], "1\nx\n3\n")
+	err = verifyColumnFiles(dataFile, dataGroups, colPaths, groupToCols, colTypes, parsers)
+	report, ok := err.(*persist.DatasetReport)
+	if !ok {
+		t.Fatalf("verifyColumnFiles error = %v, want a *persist.DatasetReport", err)
+	}
+	if report.Rows != 3 || report.BadValueCount != 1 || report.BadValues[0].Value != "x" {
+		t.Errorf("verifyColumnFiles report = %+v, want 3 rows and the bad value x", report)
+	}
+}
@@ -0,0 +1,326 @@
+package local
+
+import (
+	"errors"
+	"fmt"
+	"github.com/ProtoML/ProtoML-persist/persist"
+	"github.com/ProtoML/ProtoML-persist/persist/elastic"
+	"github.com/ProtoML/ProtoML/types"
+	"sort"
+	"strings"
+)
+
+// which induced transforms produce and consume every datagroup and state
+type lineageIndex struct {
+	itransforms    map[string]types.InducedTransform
+	dataProducer   map[string]string
+	stateProducer  map[string]string
+	dataConsumers  map[string][]string
+	stateConsumers map[string][]string
+	// looks up the datagroups read by the induced transforms
+	getDataGroup func(dataId string) (types.DataGroup, error)
+}
+
+func inducedTransformInputs(itransform types.InducedTransform) (dataIds, stateIds []string) {
+	dataIds = make([]string, 0)
+	for _, dgs := range itransform.InputsIDs {
+		for _, dg := range dgs {
+			dataIds = append(dataIds, string(dg.Id))
+		}
+	}
+	stateIds = make([]string, 0, len(itransform.InputStatesIDs))
+	for _, sid := range itransform.InputStatesIDs {
+		stateIds = append(stateIds, string(sid))
+	}
+	return
+}
+
+func inducedTransformOutputs(itransform types.InducedTransform) (dataIds, stateIds []string) {
+	dataIds = make([]string, 0)
+	for _, oids := range itransform.OutputsIDs {
+		for _, oid := range oids {
+			dataIds = append(dataIds, string(oid))
+		}
+	}
+	stateIds = make([]string, 0, len(itransform.OutputStatesIDs))
+	for _, sid := range itransform.OutputStatesIDs {
+		stateIds = append(stateIds, string(sid))
+	}
+	return
+}
+
+func newLineageIndex(getDataGroup func(dataId string) (types.DataGroup, error)) *lineageIndex {
+	return &lineageIndex{
+		itransforms:    make(map[string]types.InducedTransform),
+		dataProducer:   make(map[string]string),
+		stateProducer:  make(map[string]string),
+		dataConsumers:  make(map[string][]string),
+		stateConsumers: make(map[string][]string),
+		getDataGroup:   getDataGroup,
+	}
+}
+
+func (index *lineageIndex) add(id string, itransform types.InducedTransform) {
+	index.itransforms[id] = itransform
+	inputData, inputStates := inducedTransformInputs(itransform)
+	for _, dataId := range inputData {
+		index.dataConsumers[dataId] = append(index.dataConsumers[dataId], id)
+	}
+	for _, stateId := range inputStates {
+		index.stateConsumers[stateId] = append(index.stateConsumers[stateId], id)
+	}
+	outputData, outputStates := inducedTransformOutputs(itransform)
+	for _, dataId := range outputData {
+		index.dataProducer[dataId] = id
+	}
+	for _, stateId := range outputStates {
+		index.stateProducer[stateId] = id
+	}
+}
+
+func loadLineageIndex() (index *lineageIndex, err error) {
+	index = newLineageIndex(elastic.GetDataGroup)
+	err = elastic.EachInducedTransform(func(id string, itransform types.InducedTransform) error {
+		index.add(id, itransform)
+		return nil
+	})
+	return
+}
+
+// the transform version an induced transform was made from, zero when it has no template id
+// or the version is no longer recorded
+func lineageTemplate(itransform types.InducedTransform) (template types.Transform, err error) {
+	if len(itransform.TemplateID) == 0 {
+		return
+	}
+	record, err := elastic.GetTransformRecord(string(itransform.TemplateID))
+	if elastic.IsNotFound(err) {
+		return template, nil
+	}
+	return record.Transform, err
+}
+
+// the induced transform producing a datagroup, falling back to the datagroup source for
+// outputs not yet recorded on their induced transform
+func (index *lineageIndex) producerOfData(dataId string, datagroup types.DataGroup) (itransformId string, ok bool) {
+	if itransformId, ok = index.dataProducer[dataId]; ok {
+		return
+	}
+	_, ok = index.itransforms[datagroup.Source]
+	return datagroup.Source, ok
+}
+
+// the induced transforms producing the datagroups and states an induced transform reads.
+// datagroups split from dataset files and states without a producer have no dependency.
+func (index *lineageIndex) dependencies(itransform types.InducedTransform) (ids []string, err error) {
+	ids = make([]string, 0)
+	seen := make(map[string]bool)
+	inputData, inputStates := inducedTransformInputs(itransform)
+	for _, dataId := range inputData {
+		datagroup, err := index.getDataGroup(dataId)
+		if err != nil {
+			return ids, err
+		}
+		if producer, ok := index.producerOfData(dataId, datagroup); ok && !seen[producer] {
+			seen[producer] = true
+			ids = append(ids, producer)
+		}
+	}
+	for _, stateId := range inputStates {
+		if producer, ok := index.stateProducer[stateId]; ok && !seen[producer] {
+			seen[producer] = true
+			ids = append(ids, producer)
+		}
+	}
+	return
+}
+
+// every induced transform upstream of an induced transform, ordered so that each one comes
+// after the induced transforms it depends on
+func (store *LocalStorage) ResolveDependencies(itransformId string) (order []string, err error) {
+	index, err := loadLineageIndex()
+	if err != nil {
+		return
+	}
+	return index.resolve(itransformId)
+}
+
+func (index *lineageIndex) resolve(itransformId string) (order []string, err error) {
+	if _, ok := index.itransforms[itransformId]; !ok {
+		err = elastic.NotFoundError{Type: elastic.INDUCED_TRANSFORM_TYPE, Id: itransformId}
+		return
+	}
+	order = make([]string, 0)
+	resolved := make(map[string]bool)
+	// the induced transforms being resolved, to report cycles
+	path := make([]string, 0)
+	var visit func(id string) error
+	visit = func(id string) error {
+		if resolved[id] {
+			return nil
+		}
+		for i, pending := range path {
+			if pending == id {
+				return errors.New(fmt.Sprintf("Induced transforms have cyclic dependencies: %s -> %s", strings.Join(path[i:], " -> "), id))
+			}
+		}
+		path = append(path, id)
+		dependencies, err := index.dependencies(index.itransforms[id])
+		if err != nil {
+			return err
+		}
+		for _, dependency := range dependencies {
+			if err := visit(dependency); err != nil {
+				return err
+			}
+		}
+		path = path[:len(path)-1]
+		resolved[id] = true
+		if id != itransformId {
+			order = append(order, id)
+		}
+		return nil
+	}
+	err = visit(itransformId)
+	return
+}
+
+// walks upstream from a datagroup through the induced transforms producing every datagroup and
+// state it depends on, down to the dataset files they were split from
+func (store *LocalStorage) GetLineage(dataId string) (lineage persist.Lineage, err error) {
+	if _, err = elastic.GetDataGroup(dataId); err != nil {
+		return
+	}
+	index, err := loadLineageIndex()
+	if err != nil {
+		return
+	}
+	lineage.DataID = dataId
+	lineage.Steps = make([]persist.LineageStep, 0)
+	lineage.DatasetFiles = make([]types.DatasetFile, 0)
+
+	seenSteps := make(map[string]bool)
+	seenFiles := make(map[string]bool)
+	seenStates := make(map[string]bool)
+	seenData := map[string]bool{dataId: true}
+	dataQueue := []string{dataId}
+	stateQueue := make([]string, 0)
+	addStep := func(itransformId string) error {
+		if seenSteps[itransformId] {
+			return nil
+		}
+		seenSteps[itransformId] = true
+		itransform := index.itransforms[itransformId]
+		template, err := lineageTemplate(itransform)
+		if err != nil {
+			return err
+		}
+		inputData, inputStates := inducedTransformInputs(itransform)
+		lineage.Steps = append(lineage.Steps, persist.LineageStep{InducedTransformID: itransformId, InducedTransform: itransform, Transform: template, InputDataIDs: inputData, InputStateIDs: inputStates})
+		for _, id := range inputData {
+			if !seenData[id] {
+				seenData[id] = true
+				dataQueue = append(dataQueue, id)
+			}
+		}
+		for _, id := range inputStates {
+			if !seenStates[id] {
+				seenStates[id] = true
+				stateQueue = append(stateQueue, id)
+			}
+		}
+		return nil
+	}
+	for len(dataQueue) > 0 || len(stateQueue) > 0 {
+		if len(stateQueue) > 0 {
+			stateId := stateQueue[0]
+			stateQueue = stateQueue[1:]
+			if itransformId, ok := index.stateProducer[stateId]; ok {
+				if err = addStep(itransformId); err != nil {
+					return
+				}
+			}
+			continue
+		}
+		id := dataQueue[0]
+		dataQueue = dataQueue[1:]
+		datagroup, err := index.getDataGroup(id)
+		if err != nil {
+			return lineage, err
+		}
+		if itransformId, ok := index.producerOfData(id, datagroup); ok {
+			if err = addStep(itransformId); err != nil {
+				return lineage, err
+			}
+			continue
+		}
+
+		// datagroups without a producer were split from a dataset file
+		record, contentHash, err := elastic.GetDatasetFileRecordByDataId(id)
+		if err != nil && !elastic.IsNotFound(err) {
+			return lineage, err
+		}
+		fileKey := contentHash
+		dataFile := record.DatasetFile
+		if err != nil {
+			fileKey = datagroup.Source
+			dataFile = types.DatasetFile{Path: datagroup.Source}
+		}
+		if !seenFiles[fileKey] {
+			seenFiles[fileKey] = true
+			lineage.DatasetFiles = append(lineage.DatasetFiles, dataFile)
+		}
+	}
+	return lineage, nil
+}
+
+func sortedKeys(set map[string]bool) (keys []string) {
+	keys = make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return
+}
+
+// walks downstream from a datagroup through every induced transform reading it or anything
+// produced from it
+func (store *LocalStorage) GetDescendants(dataId string) (descendants persist.Descendants, err error) {
+	if _, err = elastic.GetDataGroup(dataId); err != nil {
+		return
+	}
+	index, err := loadLineageIndex()
+	if err != nil {
+		return
+	}
+	return index.descendants(dataId), nil
+}
+
+func (index *lineageIndex) descendants(dataId string) persist.Descendants {
+	itransforms := make(map[string]bool)
+	data := make(map[string]bool)
+	states := make(map[string]bool)
+	queue := append([]string{}, index.dataConsumers[dataId]...)
+	for len(queue) > 0 {
+		itransformId := queue[0]
+		queue = queue[1:]
+		if itransforms[itransformId] {
+			continue
+		}
+		itransforms[itransformId] = true
+		outputData, outputStates := inducedTransformOutputs(index.itransforms[itransformId])
+		for _, id := range outputData {
+			if !data[id] {
+				data[id] = true
+				queue = append(queue, index.dataConsumers[id]...)
+			}
+		}
+		for _, id := range outputStates {
+			if !states[id] {
+				states[id] = true
+				queue = append(queue, index.stateConsumers[id]...)
+			}
+		}
+	}
+	return persist.Descendants{DataID: dataId, InducedTransformIDs: sortedKeys(itransforms), DataIDs: sortedKeys(data), StateIDs: sortedKeys(states)}
+}
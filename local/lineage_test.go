@@ -0,0 +1,88 @@
+package local
+
+import (
+	"fmt"
+	"github.com/ProtoML/ProtoML-persist/persist/elastic"
+	"github.com/ProtoML/ProtoML/types"
+	"strings"
+	"testing"
+)
+
+func testInducedTransform(inputs []string, inputStates []string, outputs []string, outputStates []string) types.InducedTransform {
+	itransform := types.InducedTransform{
+		InputsIDs:       map[string][]types.DataGroupRef{"input": {}},
+		OutputsIDs:      map[string][]types.ElasticID{"output": {}},
+		InputStatesIDs:  []types.ElasticID{},
+		OutputStatesIDs: []types.ElasticID{},
+	}
+	for _, id := range inputs {
+		itransform.InputsIDs["input"] = append(itransform.InputsIDs["input"], types.DataGroupRef{Id: types.ElasticID(id)})
+	}
+	for _, id := range outputs {
+		itransform.OutputsIDs["output"] = append(itransform.OutputsIDs["output"], types.ElasticID(id))
+	}
+	for _, id := range inputStates {
+		itransform.InputStatesIDs = append(itransform.InputStatesIDs, types.ElasticID(id))
+	}
+	for _, id := range outputStates {
+		itransform.OutputStatesIDs = append(itransform.OutputStatesIDs, types.ElasticID(id))
+	}
+	return itransform
+}
+
+// raw is split from a dataset file. it4 has not recorded its output d4 yet, which only
+// names it as its source.
+func testLineageIndex() *lineageIndex {
+	sources := map[string]string{"raw": "data.csv", "d4": "it4"}
+	index := newLineageIndex(func(dataId string) (types.DataGroup, error) {
+		return types.DataGroup{Source: sources[dataId]}, nil
+	})
+	index.add("it1", testInducedTransform([]string{"raw"}, nil, []string{"d1"}, []string{"s1"}))
+	index.add("it2", testInducedTransform([]string{"d1"}, nil, []string{"d2"}, nil))
+	index.add("it3", testInducedTransform([]string{"d2"}, []string{"s1"}, []string{"d3"}, nil))
+	index.add("it4", testInducedTransform([]string{"raw"}, nil, nil, nil))
+	index.add("it5", testInducedTransform([]string{"d4"}, nil, []string{"d5"}, nil))
+	return index
+}
+
+func TestResolveDependencies(t *testing.T) {
+	index := testLineageIndex()
+	tests := map[string]string{
+		"it1": "[]",
+		"it3": "[it1 it2]",
+		"it5": "[it4]",
+	}
+	for itransformId, want := range tests {
+		order, err := index.resolve(itransformId)
+		if err != nil {
+			t.Errorf("resolve(%s) returned error: %s", itransformId, err)
+			continue
+		}
+		if fmt.Sprint(order) != want {
+			t.Errorf("resolve(%s) = %v, want %s", itransformId, order, want)
+		}
+	}
+
+	if _, err := index.resolve("missing"); !elastic.IsNotFound(err) {
+		t.Errorf("resolve(missing) = %v, want a not found error", err)
+	}
+	index.add("itA", testInducedTransform([]string{"cB"}, nil, []string{"cA"}, nil))
+	index.add("itB", testInducedTransform([]string{"cA"}, nil, []string{"cB"}, nil))
+	if _, err := index.resolve("itA"); err == nil || !strings.Contains(err.Error(), "cyclic") {
+		t.Errorf("resolve(itA) of cyclic induced transforms = %v, want a cycle error", err)
+	}
+}
+
+func TestDescendants(t *testing.T) {
+	index := testLineageIndex()
+	descendants := index.descendants("raw")
+	got := fmt.Sprint(descendants.InducedTransformIDs, descendants.DataIDs, descendants.StateIDs)
+	want := "[it1 it2 it3 it4] [d1 d2 d3] [s1]"
+	if got != want {
+		t.Errorf("descendants(raw) = %s, want %s", got, want)
+	}
+	descendants = index.descendants("d2")
+	if got = fmt.Sprint(descendants.InducedTransformIDs, descendants.DataIDs, descendants.StateIDs); got != "[it3] [d3] []" {
+		t.Errorf("descendants(d2) = %s, want [it3] [d3] []", got)
+	}
+}
@@ -1,37 +1,47 @@
 package local
 
 import (
+	"crypto/md5"
+	"encoding/hex"
 	"fmt"
+	"io"
 	"github.com/ProtoML/ProtoML-persist/persist"
 	"github.com/ProtoML/ProtoML-persist/persist/persistparsers"
 	"github.com/ProtoML/ProtoML/types"
 	"github.com/ProtoML/ProtoML/formatadaptor"
 	"github.com/ProtoML/ProtoML/logger"
 	"github.com/ProtoML/ProtoML/utils/osutils"
-	//"github.com/mattbaird/elastigo/api"
+	"github.com/mattbaird/elastigo/api"
 	//"github.com/mattbaird/elastigo/core"
+	"net"
 	"os"
 	"os/exec"
 	"path"
 	"errors"
-	"time"
 	"github.com/ProtoML/ProtoML-persist/persist/elastic"
 	"github.com/ProtoML/ProtoML/utils"
 	"encoding/json"
-	"strings"
+	"sort"
+	"sync"
 )
 
 const (
 	LOGTAG							= "Persist-Local"
 	BASE_STATE_DIRECTORY			= ".ProtoML"
 	ELASTIC_DIRECTORY				= "elasticsearch"
+	STAGING_DIRECTORY				= "staging"
+	DEFAULT_ELASTIC_PORT			= 9200
 	PROTOML_TRANSFORMS_DIRECTORY	= "ProtoML-transforms/transforms"
 	DIRECTORY_DEPTH					= 4
 	HEX_CHARS_PER_DIRECTORY_LEVEL	= 4
 	LUIGI_TASK                      = "ProtoML-persist/local/fiber/TransformTask.py"
 	TASK_PARARMS_FILE               = "params"
 	TASK_LOG_FILE					= "log"
+	TASK_DONE_FILE					= "done"
 )
+
+// returned by the entry points that run tasks once Close stopped the task watcher
+var errPersistenceClosed = errors.New("Persistence is closed")
  
 // key value storage
 func keyPath(key string) string {
@@ -49,11 +59,39 @@ func keyValuePath(key, filename string) (err string) {
 }
 
 //  keys
-func DatasetFileKey(dataset types.DatasetFile) string {
-	return osutils.MD5Hash(fmt.Sprintf("%v",dataset))
+// the content hash of a dataset file, its contents are streamed so any file size can be hashed.
+// the schema is hashed too since the same contents split differently are a different dataset,
+// while the path is not so moved files are recognized.
+func DatasetFileKey(dataset types.DatasetFile) (key string, err error) {
+	file, err := os.Open(dataset.Path)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	hasher := md5.New()
+	_, err = io.Copy(hasher, file)
+	if err != nil {
+		return
+	}
+	schema, err := json.Marshal(struct {
+		FileFormat interface{}
+		NRows interface{}
+		NCols interface{}
+		Columns interface{}
+	}{dataset.FileFormat, dataset.NRows, dataset.NCols, dataset.Columns})
+	if err != nil {
+		return
+	}
+	hasher.Write(schema)
+	return hex.EncodeToString(hasher.Sum(nil)), nil
 }
 
 
+// the key of any record, the keys below are the same for their types
+func RecordKey(elastictype, id string) string {
+	return id + "." + elastictype
+}
+
 func DataKey(dataid string) string {
 	return dataid + ".data"
 }
@@ -79,28 +117,52 @@ type TaskInsert struct {
 	TaskId string
 	TaskName string
 	Task *exec.Cmd
+	// receives the result of the task once it finished, nil when nobody waits.
+	// must be buffered since the watcher does not wait for it to be received
+	Done chan error
 }
  
 type TaskStatus struct {
 	TaskId string
 	TaskName string
+	// receives the status of the task
 	MsgChan chan TaskStatusMsg
 }
 
 type TaskStatusMsg struct {
 	TaskId string
 	TaskName string
+	// the task was started since luigi was, otherwise the watcher knows nothing of it
+	Watched bool
 	Finished bool
 	Error string
 }
 
+// the result of waiting for a watched task
+type taskFinished struct {
+	insert TaskInsert
+	err error
+}
+
 type LocalStorage struct {
 	Config           persist.Config
 	ElasticProcess   *exec.Cmd
 	LuigiProcess     *exec.Cmd
+	// receive the exit result of the elasticsearch and luigi processes
+	ElasticExited    chan error
+	LuigiExited      chan error
 	LuigiTaskInsert  chan TaskInsert
 	LuigiTaskStatus  chan TaskStatus
+	// closed by Close to stop the task watcher
+	luigiStopped     chan bool
 	FormatCollection *formatadaptor.FileFormatCollection
+	// transform files or directories that failed to load at Init
+	TransformFileErrors map[string]error
+	// closed to stop watching the transform directories
+	TransformWatcherDone chan bool
+	// staging directories of ingestions in progress, which GC keeps
+	stagingMutex  sync.Mutex
+	activeStaging map[string]bool
 }
 
 // key value storage
@@ -122,7 +184,7 @@ func (store *LocalStorage) absoluteStoragePath(spath string) string {
  
 func (store *LocalStorage) Init(config persist.Config) (err error) {
 	logger.LogInfo(LOGTAG, "Initilizing Persistance Storage")
-	store.Config.LocalPersistStorage = config.LocalPersistStorage
+	store.Config = config
 	logger.LogDebug(LOGTAG, "Initial Config: %#v", config)
 
 	if config.FormatCollection == nil {
@@ -162,34 +224,27 @@ func (store *LocalStorage) Init(config persist.Config) (err error) {
 		return
 	}
 
-	// touch elasticsearch directory
-	err = osutils.TouchDir(store.absoluteStoragePath(ELASTIC_DIRECTORY))
+	// start or connect to ElasticSearch
+	if len(store.Config.LocalPersistStorage.ElasticHost) > 0 {
+		err = store.ConnectElastic()
+	} else {
+		err = store.StartElastic()
+	}
 	if err != nil {
 		return
 	}
 
-	// start ElasticSearch
-	logger.LogInfo(LOGTAG, "Launching ElasticSearch")
-	elastic_cmd := "elasticsearch"
-/*	elastic_port := 9200
-	if store.Config.LocalPersistStorage.ElasticPort > 0 {
-		elastic_port = store.Config.LocalPersistStorage.ElasticPort
-	}*/
-	elastic_args := []string{
-		"-f",
-		fmt.Sprintf("-Des.path.data=\"%s\"", store.absoluteStoragePath(ELASTIC_DIRECTORY)),
-		fmt.Sprintf("-Des.network.host=\"%s\"", "127.0.0.1"),
-//		fmt.Sprintf("-Des.http.port=%d", elastic_port),
+	// scope records to the training namespace
+	if namespace := elastic.SanitizeNamespace(store.Config.TrainNamespace); namespace != store.Config.TrainNamespace {
+		logger.LogInfo(LOGTAG, "Using namespace %q for configured namespace %q", namespace, store.Config.TrainNamespace)
+		store.Config.TrainNamespace = namespace
 	}
-//	api.Port = fmt.Sprintf("%d",elastic_port)
-	logger.LogDebug(LOGTAG, "Elasticsearch command: %s %v", elastic_cmd, elastic_args)
-	store.ElasticProcess = exec.Command(elastic_cmd, elastic_args...)
-	err = store.ElasticProcess.Start()
+	// keep a copy of every record in its key directory, including records moved by migrations
+	elastic.ObserveRecords(recordSidecars{store})
+	err = store.useNamespace(store.Config.TrainNamespace)
 	if err != nil {
 		return
 	}
-	// wait for ElasticSearch bounce
-	time.Sleep(time.Second*10)
 
 	// add default data types
 	logger.LogDebug(LOGTAG,"%s",types.DefaultDataTypes)
@@ -198,6 +253,30 @@ func (store *LocalStorage) Init(config persist.Config) (err error) {
 		return
 	}
 
+	// add user defined data types
+	if len(store.Config.DataTypeDirectory) > 0 {
+		logger.LogDebug(LOGTAG,"Adding datatypes from %s", store.Config.DataTypeDirectory)
+		var datatypeFiles []string
+		datatypeFiles, err = persist.GetDataTypeFiles(store.Config.DataTypeDirectory)
+		if err != nil {
+			return
+		}
+		// parse every file before ordering so parents may be defined in other files
+		datatypes := make([]types.DataType, 0)
+		for _, datatypeFile := range datatypeFiles {
+			var fileDatatypes []types.DataType
+			fileDatatypes, err = loadDataTypeFile(datatypeFile)
+			if err != nil {
+				return
+			}
+			datatypes = append(datatypes, fileDatatypes...)
+		}
+		_, err = addDataTypes(datatypes)
+		if err != nil {
+			return
+		}
+	}
+
 	// add ProtoML transforms
 	logger.LogDebug(LOGTAG,"Adding ProtoML-transforms")
 	protomlDir, err := utils.ProtoMLDir()
@@ -205,16 +284,42 @@ func (store *LocalStorage) Init(config persist.Config) (err error) {
 		err = errors.New(fmt.Sprintf("%s: %v",err, "Cannot use enviromental variable PROTOMLDIR"))
 		return
 	}
+	store.TransformFileErrors = make(map[string]error)
 	transformFiles, err := persist.GetTransformFiles(path.Join(protomlDir,PROTOML_TRANSFORMS_DIRECTORY))
+	if err != nil {
+		store.TransformFileErrors[path.Join(protomlDir,PROTOML_TRANSFORMS_DIRECTORY)] = err
+		err = nil
+	}
 	if len(transformFiles) == 0 {
 		logger.LogDebug(LOGTAG, "Could not find any ProtoML-transforms")
 	}
+
+	// add external transforms
+	if len(store.Config.ExternalTransformDirectories) > 0 {
+		logger.LogDebug(LOGTAG,"Adding external transforms from %s", store.Config.ExternalTransformDirectories)
+		externalFiles, dirErrs := persist.GetExternalTransformFiles(store.Config.ExternalTransformDirectories)
+		for dir, dirErr := range dirErrs {
+			store.TransformFileErrors[dir] = dirErr
+		}
+		transformFiles = append(transformFiles, externalFiles...)
+	}
+
+	// a bad template is reported and skipped rather than failing startup
 	for _, transformFile := range transformFiles {
-		_, _, err = store.AddTransformFile(transformFile)
-		if err != nil {
-			return
+		_, _, fileErr := store.AddTransformFile(transformFile)
+		if fileErr != nil {
+			store.TransformFileErrors[transformFile] = fileErr
 		}
 	}
+	for source, sourceErr := range store.TransformFileErrors {
+		logger.LogInfo(LOGTAG, "Skipped transforms from %s: %s", source, sourceErr)
+	}
+
+	// reload templates as they change on disk
+	err = store.WatchTransforms()
+	if err != nil {
+		return
+	}
 
 	// load input data files
 	for _, datasetFile := range config.LocalPersistStorage.InputFiles {	
@@ -245,9 +350,103 @@ func (store *LocalStorage) Init(config persist.Config) (err error) {
 	return 
 }
 
+func (store *LocalStorage) useNamespace(namespace string) (err error) {
+	err = elastic.UseNamespace(namespace)
+	if err != nil {
+		return
+	}
+	// a crash while migrating may have left the records in a temporary index
+	err = elastic.RecoverMigration(elastic.CurrentIndex())
+	if err != nil {
+		return
+	}
+	exists, err := elastic.NamespaceExists(namespace)
+	if err != nil {
+		return
+	}
+	if !exists {
+		return elastic.CreateNamespace(namespace)
+	}
+	// bring indexes from older versions up to the current mappings
+	return elastic.MigrateIndex(elastic.CurrentIndex())
+}
+
+func (store *LocalStorage) ListNamespaces() (namespaces []string, err error) {
+	return elastic.ListNamespaces()
+}
+
+func (store *LocalStorage) CreateNamespace(namespace string) (err error) {
+	return elastic.CreateNamespace(namespace)
+}
+
+func (store *LocalStorage) DropNamespace(namespace string) (err error) {
+	err = elastic.DropNamespace(namespace)
+	if err != nil {
+		return
+	}
+	return store.removeSidecars(namespace)
+}
+
+func (store *LocalStorage) elasticPort() int {
+	if store.Config.LocalPersistStorage.ElasticPort > 0 {
+		return store.Config.LocalPersistStorage.ElasticPort
+	}
+	return DEFAULT_ELASTIC_PORT
+}
+
+// spawns an elasticsearch owned by this storage, stopped again by Close
+func (store *LocalStorage) StartElastic() (err error) {
+	// touch elasticsearch directory
+	err = osutils.TouchDir(store.absoluteStoragePath(ELASTIC_DIRECTORY))
+	if err != nil {
+		return
+	}
+
+	// start ElasticSearch
+	logger.LogInfo(LOGTAG, "Launching ElasticSearch")
+	elastic_cmd := "elasticsearch"
+	elastic_port := store.elasticPort()
+	elastic_args := []string{
+		"-f",
+		fmt.Sprintf("-Des.path.data=%s", store.absoluteStoragePath(ELASTIC_DIRECTORY)),
+		fmt.Sprintf("-Des.network.host=%s", "127.0.0.1"),
+		fmt.Sprintf("-Des.http.port=%d", elastic_port),
+	}
+	api.Domain = "127.0.0.1"
+	api.Port = fmt.Sprintf("%d",elastic_port)
+	logger.LogDebug(LOGTAG, "Elasticsearch command: %s %v", elastic_cmd, elastic_args)
+	store.ElasticProcess = exec.Command(elastic_cmd, elastic_args...)
+	elasticOutput, elasticExited, err := startProcess(store.ElasticProcess)
+	if err != nil {
+		return
+	}
+	store.ElasticExited = elasticExited
+	// wait for ElasticSearch bounce
+	err = waitUntilReady("Elasticsearch", elasticExited, elasticOutput, store.startupTimeout(), elasticReady)
+	return
+}
+
+// connects to an already running elasticsearch at ElasticHost, which is never spawned or stopped
+func (store *LocalStorage) ConnectElastic() (err error) {
+	host := store.Config.LocalPersistStorage.ElasticHost
+	domain, port, splitErr := net.SplitHostPort(host)
+	if splitErr != nil {
+		// no port in host
+		domain = host
+		port = fmt.Sprintf("%d", store.elasticPort())
+	}
+	logger.LogInfo(LOGTAG, "Connecting to ElasticSearch at %s:%s", domain, port)
+	api.Domain = domain
+	api.Port = port
+	err = waitUntilReady(fmt.Sprintf("Elasticsearch at %s:%s", domain, port), nil, &processOutput{}, store.startupTimeout(), elasticReady)
+	return
+}
+
 func (store *LocalStorage) StartLuigi() (err error) {
 	store.LuigiTaskInsert = make(chan TaskInsert)
 	store.LuigiTaskStatus = make(chan TaskStatus)
+	store.luigiStopped = make(chan bool)
+	go store.luigiTaskWatcher(store.LuigiTaskInsert, store.LuigiTaskStatus, store.luigiStopped)
 	
 	// start ElasticSearch
 	logger.LogInfo(LOGTAG, "Launching Luigi")
@@ -255,80 +454,110 @@ func (store *LocalStorage) StartLuigi() (err error) {
 	luigi_args := []string{}
 	logger.LogDebug(LOGTAG, "Luigi command: %s %v", luigi_cmd, luigi_args)
 	store.LuigiProcess = exec.Command(luigi_cmd, luigi_args...)
-	err = store.LuigiProcess.Start()
+	luigiOutput, luigiExited, err := startProcess(store.LuigiProcess)
 	if err != nil {
 		return
 	}
+	store.LuigiExited = luigiExited
+	err = waitUntilReady("Luigi", luigiExited, luigiOutput, store.startupTimeout(), luigiReady)
 	return
 }
 
-func luigiTaskWatcher(taskInsert chan TaskInsert, taskStatus chan TaskStatus) {
+// tracks the tasks inserted into it until they finish, marking the run directories of the tasks
+// that succeeded done. exits, killing the tasks still running, once stop is closed.
+func (store *LocalStorage) luigiTaskWatcher(taskInsert chan TaskInsert, taskStatus chan TaskStatus, stop chan bool) {
 	logtag := "LuigiWatcher"
 	tasks := make(map[string]TaskInsert)
+	// the error of every finished task, empty when it succeeded
 	taskStatuses := make(map[string]string)
+	finished := make(chan taskFinished)
+	stopped := make(chan bool)
 	defer func() {
+		close(stopped)
+		// the goroutine of every task still running reports it killed on its Done
 		for _,task := range tasks {
 			task.Task.Process.Kill()
 		}
 	}()
 	for {
 		select {
-		case insert, ok := <-taskInsert:
-			if !ok {
-				return
-			}
+		case <-stop:
+			return
+		case insert := <-taskInsert:
 			if task, ok := tasks[insert.TaskId]; ok {
 				logger.LogInfo(logtag,"Killing task %s:%s and replacing it with new task %s:%s", task.TaskName, task.TaskId, insert.TaskName, insert.TaskId)
 				task.Task.Process.Kill()
-				tasks[insert.TaskId] = insert
 			} else {
 				logger.LogInfo(logtag,"Adding task %s:%s", insert.TaskName, insert.TaskId)
-				tasks[insert.TaskId] = insert
 			}
-		case status, ok := <-taskStatus:
-			if !ok {
-				return
+			tasks[insert.TaskId] = insert
+			delete(taskStatuses, insert.TaskId)
+			// Wait may only be called once per task, so it is left to one goroutine per task
+			go func(insert TaskInsert) {
+				select {
+				case finished <- taskFinished{insert, insert.Task.Wait()}:
+				case <-stopped:
+					if insert.Done != nil {
+						insert.Done <- errors.New(fmt.Sprintf("Task %s:%s was killed when the task watcher stopped", insert.TaskName, insert.TaskId))
+					}
+				}
+			}(insert)
+		case result := <-finished:
+			insert := result.insert
+			if task, ok := tasks[insert.TaskId]; !ok || task.Task != insert.Task {
+				// killed when it was replaced
+				if insert.Done != nil {
+					insert.Done <- errors.New(fmt.Sprintf("Task %s:%s was replaced by a new run", insert.TaskName, insert.TaskId))
+				}
+				continue
+			}
+			delete(tasks, insert.TaskId)
+			status := ""
+			if result.err != nil {
+				status = fmt.Sprintf("Task %s:%s failed: %s", insert.TaskName, insert.TaskId, result.err)
+			} else if err := store.markRunComplete(insert.TaskId); err != nil {
+				status = fmt.Sprintf("Task %s:%s finished but could not be marked done: %s", insert.TaskName, insert.TaskId, err)
+			}
+			logger.LogDebug(logtag, "Task %s:%s finished %s", insert.TaskName, insert.TaskId, status)
+			taskStatuses[insert.TaskId] = status
+			if insert.Done != nil {
+				if len(status) > 0 {
+					insert.Done <- errors.New(status)
+				} else {
+					insert.Done <- nil
+				}
 			}
+		case status := <-taskStatus:
 			tsm := TaskStatusMsg{
 				TaskId: status.TaskId,
 				TaskName: status.TaskName,
 			}
-			if ts, ok := taskStatuses[status.TaskId]; ok {
-				if len(ts) > 0 {
-					tsm.Finished = true
-					tsm.Error = ts
-				}
-			} else {
-				tsm.Finished = false
-			}
-		default:
-			for taskid, task := range tasks {
-				ps := task.Task.ProcessState
-				if ps != nil {
-					if ps.Exited() {
-						logger.LogDebug(logtag, "Task %s:%s finished", task.TaskName, task.TaskId)
-						err := ""
-						if !ps.Success() {
-							err = fmt.Sprintf("Task %s:%s failed and returned with process state: %s", task.TaskName, task.TaskId, ps)
-						}
-						taskStatuses[taskid] = err
-						delete(tasks,taskid)
-					}
-				}
+			if _, ok := tasks[status.TaskId]; ok {
+				tsm.Watched = true
+			} else if ts, ok := taskStatuses[status.TaskId]; ok {
+				tsm.Watched = true
+				tsm.Finished = true
+				tsm.Error = ts
 			}
+			status.MsgChan <- tsm
 		}
 	}
 }
 
 func (store *LocalStorage) Close() (err error) {
 	logger.LogInfo(LOGTAG,"Closing persistance")
+	store.StopWatchingTransforms()
+	if store.luigiStopped != nil && !store.isClosed() {
+		// stops the task watcher, killing the tasks still running
+		close(store.luigiStopped)
+	}
 	if store.ElasticProcess != nil {
 		err = store.ElasticProcess.Process.Signal(os.Interrupt)
-		err = store.ElasticProcess.Wait()
+		err = <-store.ElasticExited
 	}
 	if store.LuigiProcess != nil {
 		err = store.LuigiProcess.Process.Signal(os.Interrupt)
-		err = store.LuigiProcess.Wait()
+		err = <-store.LuigiExited
 	}
 	return
 }
@@ -338,115 +567,184 @@ func (store *LocalStorage) IsDone(itransformId string) (bool, error) {
 	if err != nil {
 		return false, err
 	}
+	if store.luigiStopped == nil {
+		return false, errors.New("Luigi is not running")
+	}
 	mchan := make(chan TaskStatusMsg)
-	store.LuigiTaskStatus <- TaskStatus{itransformId, itransform.Name, mchan}
-	tsm, ok := <- mchan
-	if ok {
-		if tsm.Finished {
-			if len(tsm.Error) == 0 {
-				return true, errors.New(tsm.Error)
-			}
-			return true, nil
-		} else {
-			if len(tsm.Error) == 0 {
-				return false, errors.New(tsm.Error)
-			}
-			return false, nil
-		}
+	select {
+	case store.LuigiTaskStatus <- TaskStatus{TaskId: itransformId, TaskName: itransform.Name, MsgChan: mchan}:
+	case <-store.luigiStopped:
+		return false, errPersistenceClosed
 	}
-	return false, nil
+	tsm := <-mchan
+	if !tsm.Watched {
+		// runs from before luigi was started only left their done file
+		return store.isRunComplete(itransformId), nil
+	}
+	if !tsm.Finished {
+		return false, nil
+	}
+	if len(tsm.Error) > 0 {
+		return true, errors.New(tsm.Error)
+	}
+	return true, nil
 }
 
-func (store *LocalStorage) getInducedTransformDependents(itransform types.InducedTransform) (ids []string, err error) {
-	ids = make([]string,0)
-	sources := make([]string,0)
-	if itransform.InputStatesIDs != nil {
-		for _, dgs := range itransform.InputsIDs {
-			if dgs != nil {
-				for _, dg := range dgs {
-					data, err := elastic.GetDataGroup(string(dg.Id))
-					if err != nil {
-						return ids, err
-					}
-					sources = append(sources, data.Source)
-				}
-			}
-		}
+func (store *LocalStorage) Run(itransformId string) (err error) {
+	return store.RunWithUpstream(itransformId, false)
+}
+
+// runs the induced transform. With upstream set, the upstream induced transforms that have not
+// completed are run to completion first, dependencies before their dependents.
+func (store *LocalStorage) RunWithUpstream(itransformId string, upstream bool) (err error) {
+	done, err := store.IsDone(itransformId)
+	if done && err != nil {
+		logger.LogInfo(LOGTAG, "Running induced transform %s again after it failed: %s", itransformId, err)
+		done, err = false, nil
+	}
+	if err != nil || done {
+		return
 	}
 	
-	for _, source := range sources {
-		if strings.Contains(source, ".") {
-			continue
+	itransform, err := elastic.GetInducedTransform(itransformId)
+	if err != nil {
+		return
+	}
+	dependencies, err := store.ResolveDependencies(itransformId)
+	if err != nil {
+		return
+	}
+	missing := make([]string, 0)
+	for _, dependency := range dependencies {
+		if !store.isRunComplete(dependency) {
+			missing = append(missing, dependency)
 		}
-		ids = append(ids, source)
 	}
-	return
-}
+	if upstream {
+		for _, dependency := range missing {
+			err = store.runToCompletion(dependency)
+			if err != nil {
+				return
+			}
+		}
+	} else if len(missing) > 0 {
+		logger.LogInfo(LOGTAG, "Running induced transform %s before its upstream induced transforms %v completed", itransformId, missing)
+	}
 
-func (store *LocalStorage) Run(itransformId string) (err error) {
-	done, err := store.IsDone(itransformId)
+	task, err := store.startInducedTransform(itransformId, itransform)
 	if err != nil {
 		return
 	}
-	if done {
+	return store.watchTask(TaskInsert{TaskId: itransformId, TaskName: itransform.Name, Task: task})
+}
+
+// hands a started task to the task watcher, killing it again when the persistence is closed
+func (store *LocalStorage) watchTask(insert TaskInsert) (err error) {
+	if store.luigiStopped == nil {
+		insert.Task.Process.Kill()
+		return errors.New("Luigi is not running")
+	}
+	select {
+	case store.LuigiTaskInsert <- insert:
+		return
+	case <-store.luigiStopped:
+		insert.Task.Process.Kill()
+		return errPersistenceClosed
+	}
+}
+
+// whether Close stopped the task watcher
+func (store *LocalStorage) isClosed() bool {
+	select {
+	case <-store.luigiStopped:
+		return true
+	default:
+		return false
+	}
+}
+
+// the run directory of an induced transform holds a done file once it ran successfully to completion
+func (store *LocalStorage) isRunComplete(itransformId string) bool {
+	return osutils.PathExists(store.getFilePath(InducedTransformKey(itransformId), TASK_DONE_FILE))
+}
+
+// marks the run directory of an induced transform done after it ran successfully
+func (store *LocalStorage) markRunComplete(itransformId string) (err error) {
+	done, err := osutils.TouchFile(store.getFilePath(InducedTransformKey(itransformId), TASK_DONE_FILE))
+	if err != nil {
 		return
 	}
-	
+	return done.Close()
+}
+
+// runs an induced transform through the task watcher and waits for it to finish,
+// the watcher marks its run directory done on success
+func (store *LocalStorage) runToCompletion(itransformId string) (err error) {
 	itransform, err := elastic.GetInducedTransform(itransformId)
 	if err != nil {
 		return
 	}
-	sourceIds, err := store.getInducedTransformDependents(itransform)
+	logger.LogInfo(LOGTAG, "Running upstream induced transform %s:%s", itransform.Name, itransformId)
+	task, err := store.startInducedTransform(itransformId, itransform)
+	if err != nil {
+		return
+	}
+	done := make(chan error, 1)
+	err = store.watchTask(TaskInsert{TaskId: itransformId, TaskName: itransform.Name, Task: task, Done: done})
 	if err != nil {
 		return
 	}
-	//for _, sourceId := range sourceIds {
-	//	err := 
-	//}
-	//finish
+	err = <-done
+	if err != nil {
+		return errors.New(fmt.Sprintf("Upstream induced transform %s:%s failed: %s", itransform.Name, itransformId, err))
+	}
+	return
+}
 
+// writes the parameters of an induced transform into its run directory and starts its luigi task
+func (store *LocalStorage) startInducedTransform(itransformId string, itransform types.InducedTransform) (task *exec.Cmd, err error) {
 	protoml_folder, err := utils.ProtoMLDir()
 	if err != nil {
-		return err
+		return
 	}
 
 	runDir := store.getKeyPath(InducedTransformKey(itransformId))
 	err = osutils.TouchDir(runDir)
 	if err != nil {
-		return err
+		return
 	}
+	// a new run is not complete until it succeeds
+	os.Remove(path.Join(runDir, TASK_DONE_FILE))
 	
 	// Put the JSON of the induced transform and log into the given run folder
 	params, err := json.Marshal(itransform)
 	if err != nil {
-		return err
+		return
 	}
 	params_path := path.Join(runDir, TASK_PARARMS_FILE)
 	params_file, err := osutils.TouchFile(params_path)
 	if err != nil {
-		return err
+		return
 	}
 	_, err = params_file.Write(params)
 	if err != nil {
-		return err
+		return
 	}
 	params_file.Close()
 	log_path := path.Join(runDir, TASK_LOG_FILE)
 	log_file, err := osutils.TouchFile(log_path)
 	if err != nil {
-		return err
+		return
 	}
 	//defer log_file.Close()
 
 	// Execute the Luigi Task
 	// Get the path of the Luigi task
 	luigi_path := path.Join(protoml_folder, LUIGI_TASK)
-	task := exec.Command(luigi_path, "--directory", runDir, "--run_context", itransform.Exec, "--params_file", params_path)
+	task = exec.Command(luigi_path, "--directory", runDir, "--run_context", itransform.Exec, "--params_file", params_path)
 	task.Stdout = log_file
 	task.Stderr = log_file
-	task.Start()
-	
-	store.LuigiTaskInsert <- TaskInsert{itransformId, itransform.Name, task}
+	err = task.Start()
 	return
 }
 
@@ -466,117 +764,96 @@ func (store *LocalStorage) GetTransformLogFile(transformId string) (paths string
 func (store *LocalStorage) GetGraph() (graph types.ProtoMLGraph, err error) {
 	graph.Vertices = make([]types.ProtoMLVertex,0)
 	graph.Edges = make([]types.ProtoMLEdge,0)
-	dataIds, err := elastic.ElasticGetAll(elastic.DATAGROUP_TYPE)
-	if err != nil {
-		return
-	}
+
+	// add data, state
 	dataSet := make(map[types.ElasticID]bool)
-	for _, id := range dataIds {
+	err = elastic.ElasticEachId(elastic.DATAGROUP_TYPE, func(id string) error {
 		dataSet[types.ElasticID(id)] = true
-	}
-	itransformIds, err := elastic.ElasticGetAll(elastic.INDUCED_TRANSFORM_TYPE)
-	if err != nil {
-		return
-	}
-	itransformSet := make(map[types.ElasticID]bool)
-	for _, id := range itransformIds {
-		itransformSet[types.ElasticID(id)] = true
-	}
-	stateIds, err := elastic.ElasticGetAll(elastic.STATE_TYPE)
+		graph.Vertices = append(graph.Vertices, types.NewProtoMLVertex(elastic.DATAGROUP_TYPE, types.ElasticID(id)))
+		return nil
+	})
 	if err != nil {
 		return
 	}
 	stateSet := make(map[types.ElasticID]bool)
-	for _, id := range stateIds {
+	err = elastic.ElasticEachId(elastic.STATE_TYPE, func(id string) error {
 		stateSet[types.ElasticID(id)] = true
+		graph.Vertices = append(graph.Vertices, types.NewProtoMLVertex(elastic.STATE_TYPE, types.ElasticID(id)))
+		return nil
+	})
+	if err != nil {
+		return
 	}
 
-	// add data, transform, state
-	for dataId, _ := range dataSet {
-		graph.Vertices = append(graph.Vertices, types.NewProtoMLVertex(elastic.DATAGROUP_TYPE, dataId))
-	}	
-	for itransformId, _ := range itransformSet {
-	 	graph.Vertices = append(graph.Vertices, types.NewProtoMLVertex(elastic.INDUCED_TRANSFORM_TYPE, itransformId))
-	}
-
-	for stateId, _ := range stateSet {
-		graph.Vertices = append(graph.Vertices, types.NewProtoMLVertex(elastic.STATE_TYPE, stateId))
-	}
-
-	for id, _ := range itransformSet {
-		itransform, err := elastic.GetInducedTransform(string(id))
-		if err != nil {
-			return graph, err
-		}
-		if itransform.InputsIDs != nil {
-			// add input -> transform edges
-			for _, dgs := range itransform.InputsIDs {
-				if dgs != nil {
-					for _, dg := range dgs {
-						if _, ok := dataSet[dg.Id]; !ok {
-							err = errors.New(fmt.Sprintf("Transform %s takes in datagroup that does not exist, its id is %s", dg.Id))
-							return graph, err
-						} else {
-							edge := types.NewProtoMLEdge(elastic.DATAGROUP_TYPE, dg.Id, elastic.INDUCED_TRANSFORM_TYPE, id)
-							graph.Edges = append(graph.Edges, edge)
-						}						
-					}
+	// add transforms and their edges
+	err = elastic.EachInducedTransform(func(itransformId string, itransform types.InducedTransform) (err error) {
+		id := types.ElasticID(itransformId)
+		graph.Vertices = append(graph.Vertices, types.NewProtoMLVertex(elastic.INDUCED_TRANSFORM_TYPE, id))
+		// add input -> transform edges
+		for _, dgs := range itransform.InputsIDs {
+			for _, dg := range dgs {
+				if _, ok := dataSet[dg.Id]; !ok {
+					return errors.New(fmt.Sprintf("Transform %s takes in datagroup that does not exist, its id is %s", id, dg.Id))
 				}
+				graph.Edges = append(graph.Edges, types.NewProtoMLEdge(elastic.DATAGROUP_TYPE, dg.Id, elastic.INDUCED_TRANSFORM_TYPE, id))
 			}
 		}
-		if itransform.OutputsIDs != nil {
-			// add transform -> output
-			for _, dgs := range itransform.OutputsIDs {
-				if dgs != nil {
-					for _, oid := range dgs {
-						if _, ok := dataSet[oid]; !ok {
-							err = errors.New(fmt.Sprintf("Transform %s outputs datagroup that does not exist its id is %s", oid))
-							return graph, err
-						} else {
-							edge := types.NewProtoMLEdge(elastic.INDUCED_TRANSFORM_TYPE, id, elastic.DATAGROUP_TYPE, oid)
-							graph.Edges = append(graph.Edges, edge)
-						}
-					}
+		// add transform -> output
+		for _, dgs := range itransform.OutputsIDs {
+			for _, oid := range dgs {
+				if _, ok := dataSet[oid]; !ok {
+					return errors.New(fmt.Sprintf("Transform %s outputs datagroup that does not exist its id is %s", id, oid))
 				}
+				graph.Edges = append(graph.Edges, types.NewProtoMLEdge(elastic.INDUCED_TRANSFORM_TYPE, id, elastic.DATAGROUP_TYPE, oid))
 			}
 		}
-		
-		if itransform.InputStatesIDs != nil {
-			// add state -> transform input
-			for _, sid := range itransform.InputStatesIDs {
-				if _, ok := stateSet[sid]; !ok {
-					err = errors.New(fmt.Sprintf("Transform %s takes in a state that does not exist its id is %s", sid))
-					return graph, err
-					
-				} else {
-					edge := types.NewProtoMLEdge(elastic.STATE_TYPE, sid, elastic.INDUCED_TRANSFORM_TYPE, id)
-					graph.Edges = append(graph.Edges, edge)
-				}
+		// add state -> transform input
+		for _, sid := range itransform.InputStatesIDs {
+			if _, ok := stateSet[sid]; !ok {
+				return errors.New(fmt.Sprintf("Transform %s takes in a state that does not exist its id is %s", id, sid))
 			}
+			graph.Edges = append(graph.Edges, types.NewProtoMLEdge(elastic.STATE_TYPE, sid, elastic.INDUCED_TRANSFORM_TYPE, id))
 		}
-		if itransform.OutputStatesIDs != nil {
-			// add state -> transform input
-			for _, sid := range itransform.OutputStatesIDs {
-				if _, ok := stateSet[sid]; !ok {
-					err = errors.New(fmt.Sprintf("Transform %s takes in a state that does not exist its id is %s", sid))
-					return graph, err
-					
-				} else {
-					
-					edge := types.NewProtoMLEdge(elastic.INDUCED_TRANSFORM_TYPE, id, elastic.STATE_TYPE, sid)
-					graph.Edges = append(graph.Edges, edge)
-				}
+		// add transform -> state output
+		for _, sid := range itransform.OutputStatesIDs {
+			if _, ok := stateSet[sid]; !ok {
+				return errors.New(fmt.Sprintf("Transform %s outputs a state that does not exist its id is %s", id, sid))
 			}
+			graph.Edges = append(graph.Edges, types.NewProtoMLEdge(elastic.INDUCED_TRANSFORM_TYPE, id, elastic.STATE_TYPE, sid))
 		}
-	}
-
+		return
+	})
 	return
 }
 
 
 
+func (store *LocalStorage) SearchDataGroups(query elastic.SearchQuery) (results []elastic.DataGroupResult, err error) {
+	return elastic.SearchDataGroups(query)
+}
+
+func (store *LocalStorage) SearchTransforms(query elastic.SearchQuery) (results []elastic.TransformResult, err error) {
+	return elastic.SearchTransforms(query)
+}
+
+func (store *LocalStorage) SearchInducedTransforms(query elastic.SearchQuery) (results []elastic.InducedTransformResult, err error) {
+	return elastic.SearchInducedTransforms(query)
+}
+
+func (store *LocalStorage) SelectColumnsByTag(tag string, query elastic.SearchQuery) (columns []elastic.ColumnReference, err error) {
+	return elastic.SelectColumnsByTag(tag, query)
+}
+
 // add induced transform
 func (store *LocalStorage) AddInducedTransform(itransform types.InducedTransform) (itransformID string, err error) {
+	// pin to the latest version of the named template when no version is given
+	if len(itransform.TemplateID) == 0 && len(itransform.Template) > 0 {
+		_, templateID, err := elastic.GetTransformByName(itransform.Template)
+		if err != nil {
+			return "", err
+		}
+		itransform.TemplateID = types.ElasticID(templateID)
+	}
 	logger.LogDebug(LOGTAG, "Adding Induced Transform named (%s) from transform id (%s)", itransform.Name, itransform.TemplateID)
 	// Get transform template
 	// parse and validate induced transform
@@ -618,6 +895,107 @@ func (store *LocalStorage) UpdateInducedTransform(itransformId string, itransfor
 }
 	
 
+func loadDataTypeFile(datatypeFile string) (datatypes []types.DataType, err error) {
+	jsonBlob, err := osutils.LoadBlob(datatypeFile)
+	if err != nil {
+		return
+	}
+	datatypes, err = persistparsers.ParseDataTypes(jsonBlob)
+	if err != nil {
+		err = errors.New(fmt.Sprintf("Parse Error In DataType File %s: %s", datatypeFile, err))
+	}
+	return
+}
+
+// orders datatypes by their parents and registers them
+func addDataTypes(datatypes []types.DataType) (sorted []types.DataType, err error) {
+	sorted, err = persistparsers.SortDataTypes(datatypes, persistparsers.IsDataTypeRegistered)
+	if err != nil {
+		return
+	}
+	err = persist.AddDataTypes(sorted)
+	return
+}
+
+// list induced transforms pinned to an outdated transform version.
+// induced transforms without a known template or without a current version of it are skipped.
+func (store *LocalStorage) GetOutdatedInducedTransforms() (outdated []persist.OutdatedInducedTransform, err error) {
+	outdated = make([]persist.OutdatedInducedTransform, 0)
+	err = elastic.EachInducedTransform(func(itransformId string, itransform types.InducedTransform) error {
+		if len(itransform.TemplateID) == 0 {
+			logger.LogInfo(LOGTAG, "Skipping Induced Transform %s pinned to no transform version", itransformId)
+			return nil
+		}
+		pinned, err := elastic.GetTransformRecord(string(itransform.TemplateID))
+		if elastic.IsNotFound(err) {
+			logger.LogInfo(LOGTAG, "Skipping Induced Transform %s pinned to unknown transform id %s", itransformId, itransform.TemplateID)
+			return nil
+		} else if err != nil {
+			return err
+		}
+		latest, latestId, err := elastic.GetTransformRecordByName(pinned.Name)
+		if elastic.IsNotFound(err) {
+			logger.LogInfo(LOGTAG, "Skipping Induced Transform %s, every version of transform %s was removed", itransformId, pinned.Name)
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if latest.Version > pinned.Version {
+			outdated = append(outdated, persist.OutdatedInducedTransform{
+				InducedTransformID: itransformId,
+				TemplateID: string(itransform.TemplateID),
+				TemplateVersion: pinned.Version,
+				LatestTemplateID: latestId,
+				LatestTemplateVersion: latest.Version,
+			})
+		}
+		return nil
+	})
+	return
+}
+
+// repin induced transform to the latest version of its transform.
+// the induced transform is left untouched if it is not valid against the latest version.
+func (store *LocalStorage) UpgradeInducedTransform(itransformId string) (templateID string, err error) {
+	itransform, err := elastic.GetInducedTransform(itransformId)
+	if err != nil {
+		return
+	}
+	pinned, err := elastic.GetTransformRecord(string(itransform.TemplateID))
+	if err != nil {
+		return
+	}
+	latest, latestId, err := elastic.GetTransformRecordByName(pinned.Name)
+	if err != nil {
+		return
+	}
+	// removed versions are skipped, so the latest may be older than the pinned version
+	if latest.Version <= pinned.Version {
+		return string(itransform.TemplateID), nil
+	}
+	templateID = latestId
+	logger.LogDebug(LOGTAG, "Upgrading Induced Transform %s from transform id (%s) to (%s)", itransformId, itransform.TemplateID, templateID)
+	itransform.TemplateID = types.ElasticID(templateID)
+	err = persistparsers.ValidateInducedTransform(itransform)
+	if err != nil {
+		err = errors.New(fmt.Sprintf("Induced Transform %s is not valid against transform id %s: %s", itransformId, templateID, err))
+		return
+	}
+	itransform.Error = ""
+	err = elastic.UpdateInducedTransform(itransformId, itransform)
+	return
+}
+
+// load datatypes from a file
+func (store *LocalStorage) AddDataTypeFile(datatypeFile string) (datatypes []types.DataType, err error) {
+	logger.LogDebug(LOGTAG, "Adding DataTypes from %s", datatypeFile)
+	datatypes, err = loadDataTypeFile(datatypeFile)
+	if err != nil {
+		return
+	}
+	return addDataTypes(datatypes)
+}
+
 // load a transform from a file
 func (store *LocalStorage) AddTransformFile(transformFile string) (transform types.Transform, transformID string, err error) {
 	logger.LogDebug(LOGTAG, "Adding Transform from %s", transformFile)
@@ -634,95 +1012,253 @@ func (store *LocalStorage) AddTransformFile(transformFile string) (transform typ
 	transform.Template = transformFile
 	logger.LogDebug(LOGTAG, "\tTransform parsed")
 
-	// add transform into elastic search
-	transformID, err = elastic.AddTransform(transform)
+	// add transform into elastic search, keyed by name and contents so reloading is a no-op
+	transformID, created, err := elastic.AddTransformVersion(transform, osutils.MD5Hash(string(jsonBlob)))
 	if err != nil {
 		return
 	}
-	logger.LogDebug(LOGTAG, "Result Transform ID: %s", transformID)
+	if created {
+		logger.LogDebug(LOGTAG, "Result Transform ID: %s", transformID)
+	} else {
+		logger.LogDebug(LOGTAG, "Transform unchanged, existing Transform ID: %s", transformID)
+	}
 	return
 }
 
+// get the latest version of a transform by name
+func (store *LocalStorage) GetTransformByName(name string) (transform types.Transform, transformID string, err error) {
+	return elastic.GetTransformByName(name)
+}
+
 // reprents the physical data columns of each datagroup
 type dataGroupParts struct {
 	ParentGroupId string
 	ColPaths []string
+	ColumnTags [][]string
+}
+const DATAGROUPPARTS_TYPE = elastic.DATAPARTS_TYPE
+
+
+// the dataset tags of each column in each data group
+func dataGroupColumnTags(dataFile types.DatasetFile, groupToCols [][]int) (columnTags [][][]string) {
+	tagsByCol := make(map[int][]string)
+	for tag, indices := range dataFile.Columns.Tags {
+		for _, index := range indices {
+			tagsByCol[index] = append(tagsByCol[index], tag)
+		}
+	}
+	columnTags = make([][][]string, len(groupToCols))
+	for i, cols := range groupToCols {
+		columnTags[i] = make([][]string, len(cols))
+		for gi, ci := range cols {
+			columnTags[i][gi] = append([]string{}, tagsByCol[ci]...)
+			sort.Strings(columnTags[i][gi])
+		}
+	}
+	return
 }
-const DATAGROUPPARTS_TYPE = "dataparts"
 
+// tracks what an ingestion has put in place so it can be undone
+type ingestion struct {
+	dataDirs []string
+	dataIds []string
+	dataPartIds []string
+	datasetFileId string
+	stagingDir string
+}
+
+// removes the files and records of a failed ingestion
+func (ingest *ingestion) rollback() {
+	if len(ingest.datasetFileId) > 0 {
+		if err := elastic.ElasticDelete(elastic.DATAFILE_TYPE, ingest.datasetFileId); err != nil && !elastic.IsNotFound(err) {
+			logger.LogInfo(LOGTAG, "Rollback could not delete dataset file %s: %s", ingest.datasetFileId, err)
+		}
+	}
+	for _, id := range ingest.dataPartIds {
+		if err := elastic.ElasticDelete(DATAGROUPPARTS_TYPE, id); err != nil && !elastic.IsNotFound(err) {
+			logger.LogInfo(LOGTAG, "Rollback could not delete datapart %s: %s", id, err)
+		}
+	}
+	for _, id := range ingest.dataIds {
+		if err := elastic.ElasticDelete(elastic.DATAGROUP_TYPE, id); err != nil && !elastic.IsNotFound(err) {
+			logger.LogInfo(LOGTAG, "Rollback could not delete datagroup %s: %s", id, err)
+		}
+	}
+	for _, dir := range ingest.dataDirs {
+		if err := os.RemoveAll(dir); err != nil {
+			logger.LogInfo(LOGTAG, "Rollback could not remove %s: %s", dir, err)
+		}
+	}
+}
 
 // insert data file into persist
 func (store *LocalStorage) AddDataFile(dataFile types.DatasetFile) (dataID []string, err error) {
+	return store.AddDataFileWithOptions(dataFile, persist.IngestOptions{})
+}
+
+// insert data file into persist.
+// the file is split in a staging directory, column files are moved into place and only then is
+// the metadata written. Any failure removes everything the ingestion added.
+func (store *LocalStorage) AddDataFileWithOptions(dataFile types.DatasetFile, options persist.IngestOptions) (dataID []string, err error) {
 	logger.LogDebug(LOGTAG, "Adding dataset file %s", dataFile.Path)
+	// the last progress is repeated as done however the ingestion ends
+	if progress := options.Progress; progress != nil {
+		last := persist.IngestProgress{Path: dataFile.Path}
+		options.Progress = func(update persist.IngestProgress) {
+			last = update
+			progress(update)
+		}
+		defer func() {
+			last.Done = true
+			progress(last)
+		}()
+	}
 	// validate all dataset datatypes exist
 	for typename, _ := range dataFile.Columns.ExclusiveTypes {
 		if _, err := elastic.GetDataType(typename); err != nil {
 			return dataID, err
 		}
 	}
-	
-	// setup dataset dir
-	keyPath := store.getKeyPath(DatasetFileKey(dataFile))
-	err = osutils.TouchDir(keyPath)
+
+	// identical contents were already ingested, possibly from another path
+	contentHash, err := DatasetFileKey(dataFile)
+	if err != nil {
+		return
+	}
+	existing, err := elastic.GetDatasetFileRecord(contentHash)
+	if err == nil {
+		if existing.Path != dataFile.Path {
+			logger.LogInfo(LOGTAG, "Dataset file %s has the same contents as %s, reusing its datagroups", dataFile.Path, existing.Path)
+		} else {
+			logger.LogDebug(LOGTAG, "Dataset file %s already ingested", dataFile.Path)
+		}
+		return existing.DataIds, nil
+	} else if !elastic.IsNotFound(err) {
+		return
+	}
+	err = store.warnChangedDatasetFile(dataFile.Path)
 	if err != nil {
 		return
 	}
 
-	// split dataset into data groups, column files, and array index map from file to data group
-	dataGroups, colPaths, groupToCols, err := store.FormatCollection.Split(dataFile, keyPath)
+	// setup staging dir
+	stagingId, err := elastic.NewID()
 	if err != nil {
 		return
 	}
-	 
-	// add data groups into elasticsearch
-	dataID = make([]string,len(dataGroups))
-	for i, dataGroup := range dataGroups {
-		id, err := elastic.AddDataGroup(dataGroup)
+	ingest := &ingestion{stagingDir: path.Join(store.absoluteStoragePath(STAGING_DIRECTORY), stagingId)}
+	store.beginStaging(stagingId)
+	defer store.endStaging(stagingId)
+	err = osutils.TouchDir(ingest.stagingDir)
+	if err != nil {
+		return
+	}
+	defer os.RemoveAll(ingest.stagingDir)
+	defer func() {
 		if err != nil {
-			return []string{}, err
+			logger.LogInfo(LOGTAG, "Rolling back dataset file %s: %s", dataFile.Path, err)
+			ingest.rollback()
+			dataID = []string{}
 		}
-		dataID[i] = id
+	}()
+
+	// split dataset into data groups, column files, and array index map from file to data group
+	dataGroups, colPaths, groupToCols, err := store.splitDataFile(dataFile, ingest.stagingDir, options)
+	if err != nil {
+		return
 	}
+	columnTags := dataGroupColumnTags(dataFile, groupToCols)
 
-	// setup data group dirs
-	dataDirs := make([]string,len(dataGroups))
-	logger.LogDebug(LOGTAG, "Result Data Ids:")
-	for i, id := range dataID {
-		logger.LogDebug(LOGTAG, "\t%s",id)
-		dataDirs[i] = store.getKeyPath(DataKey(id))
-		err = osutils.TouchDir(dataDirs[i])
-		if err != nil {
+	// ids are chosen up front so files can be placed before any metadata exists
+	dataID = make([]string, len(dataGroups))
+	dataPartIds := make([]string, len(dataGroups))
+	for i := range dataGroups {
+		if dataID[i], err = elastic.NewID(); err != nil {
+			return
+		}
+		if dataPartIds[i], err = elastic.NewID(); err != nil {
 			return
 		}
 	}
 
-	
-	// construct dataparts
+	// gather group cols in staging group dirs
 	dataParts := make([]dataGroupParts, len(dataGroups))
 	for i, dataGroup := range dataGroups {
-		id := dataID[i]  
+		id := dataID[i]
+		groupStagingDir := path.Join(ingest.stagingDir, id)
+		err = osutils.TouchDir(groupStagingDir)
+		if err != nil {
+			return
+		}
+		dataDir := store.getKeyPath(DataKey(id))
 		colGroupPaths := make([]string,len(groupToCols[i]))
-		// move group cols into group dir
 		for gi, ci := range groupToCols[i] {
-			colPath := colPaths[ci]
-			colGroupPaths[gi] = path.Join(dataDirs[i], fmt.Sprintf("%010d.%s",gi,dataGroup.FileFormat))
-			err = os.Rename(colPath, colGroupPaths[i])
+			colFile := fmt.Sprintf("%010d.%s",gi,dataGroup.FileFormat)
+			err = os.Rename(colPaths[ci], path.Join(groupStagingDir, colFile))
 			if err != nil {
-				return dataID, err
+				return
 			}
+			colGroupPaths[gi] = path.Join(dataDir, colFile)
 		}
-		dataParts[i] = dataGroupParts{id,colGroupPaths}
+		dataParts[i] = dataGroupParts{id,colGroupPaths,columnTags[i]}
 	}
 
-	// add data parts into elastic
-	logger.LogDebug(LOGTAG,"Separated DataPart Ids:")
-	for _, datapart := range dataParts {
-		id, err := elastic.ElasticAdd(DATAGROUPPARTS_TYPE, datapart)
+	// move each group dir into place in one rename
+	logger.LogDebug(LOGTAG, "Result Data Ids:")
+	for _, id := range dataID {
+		logger.LogDebug(LOGTAG, "\t%s",id)
+		dataDir := store.getKeyPath(DataKey(id))
+		err = osutils.TouchDir(path.Dir(dataDir))
 		if err != nil {
-			return dataID, err
+			return
 		}
+		err = os.Rename(path.Join(ingest.stagingDir, id), dataDir)
+		if err != nil {
+			return
+		}
+		ingest.dataDirs = append(ingest.dataDirs, dataDir)
+	}
+
+	// add data groups into elasticsearch
+	ingest.dataIds = dataID
+	_, err = elastic.AddDataGroupsWithIds(dataID, dataGroups, columnTags)
+	if err != nil {
+		return
+	}
+
+	// add data parts into elastic
+	dataPartRecords := make([]interface{}, len(dataParts))
+	for i, datapart := range dataParts {
+		dataPartRecords[i] = datapart
+	}
+	ingest.dataPartIds = dataPartIds
+	_, err = elastic.ElasticBulkAddWithIds(DATAGROUPPARTS_TYPE, dataPartIds, dataPartRecords)
+	if err != nil {
+		return
+	}
+	logger.LogDebug(LOGTAG,"Separated DataPart Ids:")
+	for _, id := range dataPartIds {
 		logger.LogDebug(LOGTAG, "\t%s",id)
 	}
 
+	// record the dataset file last so it only names complete ingestions
+	ingest.datasetFileId = contentHash
+	err = elastic.AddDatasetFileRecord(contentHash, elastic.DatasetFileRecord{DatasetFile: dataFile, DataIds: dataID})
+	if err != nil {
+		return
+	}
+
 	return dataID, nil
 }
+
+// warns when a path was ingested before with other contents, its old datagroups are kept
+func (store *LocalStorage) warnChangedDatasetFile(datasetPath string) (err error) {
+	previous, err := elastic.GetDatasetFileRecordsByPath(datasetPath)
+	if err != nil {
+		return
+	}
+	for contentHash, record := range previous {
+		logger.LogInfo(LOGTAG, "Dataset file %s changed since it was ingested as %s, its datagroups %v are kept", datasetPath, contentHash, record.DataIds)
+	}
+	return
+}
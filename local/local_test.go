@@ -0,0 +1,55 @@
+package local
+
+import (
+	"os/exec"
+	"testing"
+	"time"
+)
+
+func startTestTask(t *testing.T) *exec.Cmd {
+	task := exec.Command("sleep", "30")
+	if err := task.Start(); err != nil {
+		t.Fatalf("starting test task: %s", err)
+	}
+	return task
+}
+
+func TestWatcherReportsTasksKilledOnClose(t *testing.T) {
+	store := &LocalStorage{
+		LuigiTaskInsert: make(chan TaskInsert),
+		LuigiTaskStatus: make(chan TaskStatus),
+		luigiStopped:    make(chan bool),
+	}
+	go store.luigiTaskWatcher(store.LuigiTaskInsert, store.LuigiTaskStatus, store.luigiStopped)
+
+	replacedDone := make(chan error, 1)
+	runningDone := make(chan error, 1)
+	if err := store.watchTask(TaskInsert{TaskId: "it1", TaskName: "sleep", Task: startTestTask(t), Done: replacedDone}); err != nil {
+		t.Fatalf("watchTask returned error: %s", err)
+	}
+	if err := store.watchTask(TaskInsert{TaskId: "it1", TaskName: "sleep", Task: startTestTask(t), Done: runningDone}); err != nil {
+		t.Fatalf("watchTask returned error: %s", err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatalf("Close returned error: %s", err)
+	}
+
+	for name, done := range map[string]chan error{"replaced": replacedDone, "running": runningDone} {
+		select {
+		case err := <-done:
+			if err == nil {
+				t.Errorf("%s task reported success after Close, want an error", name)
+			}
+		case <-time.After(10 * time.Second):
+			t.Errorf("%s task never reported a result after Close", name)
+		}
+	}
+
+	task := startTestTask(t)
+	if err := store.watchTask(TaskInsert{TaskId: "it2", TaskName: "sleep", Task: task}); err != errPersistenceClosed {
+		t.Errorf("watchTask after Close = %v, want %v", err, errPersistenceClosed)
+	}
+	if err := task.Wait(); err == nil {
+		t.Errorf("task handed to a closed store was not killed")
+	}
+}
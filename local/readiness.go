@@ -0,0 +1,122 @@
+package local
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/ProtoML/ProtoML/logger"
+	"github.com/mattbaird/elastigo/api"
+	"net/http"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_STARTUP_TIMEOUT = 60 // seconds
+	READINESS_POLL_INTERVAL = time.Millisecond * 500
+	LUIGI_PORT              = 8082
+	MAX_PROCESS_OUTPUT      = 1 << 16
+)
+
+// captures the output of a child process so it can be reported if the process never becomes ready
+type processOutput struct {
+	mutex sync.Mutex
+	buf   bytes.Buffer
+}
+
+func (output *processOutput) Write(p []byte) (n int, err error) {
+	output.mutex.Lock()
+	defer output.mutex.Unlock()
+	n, err = output.buf.Write(p)
+	// keep only the tail of long running processes
+	if extra := output.buf.Len() - MAX_PROCESS_OUTPUT; extra > 0 {
+		output.buf.Next(extra)
+	}
+	return
+}
+
+func (output *processOutput) String() string {
+	output.mutex.Lock()
+	defer output.mutex.Unlock()
+	return output.buf.String()
+}
+
+func (store *LocalStorage) startupTimeout() time.Duration {
+	if store.Config.LocalPersistStorage.StartupTimeout > 0 {
+		return time.Second * time.Duration(store.Config.LocalPersistStorage.StartupTimeout)
+	}
+	return time.Second * DEFAULT_STARTUP_TIMEOUT
+}
+
+// starts a process capturing its stderr. exited receives the result of waiting on the process
+// and is closed afterwards, so receiving from it never blocks once the process is gone.
+func startProcess(process *exec.Cmd) (output *processOutput, exited chan error, err error) {
+	output = &processOutput{}
+	process.Stderr = output
+	err = process.Start()
+	if err != nil {
+		return
+	}
+	exited = make(chan error, 1)
+	go func() {
+		exited <- process.Wait()
+		close(exited)
+	}()
+	return
+}
+
+// polls ready until it succeeds, the process exits, or the timeout passes.
+// exited may be nil for processes not owned by this storage.
+func waitUntilReady(name string, exited chan error, output *processOutput, timeout time.Duration, ready func() error) (err error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		err = ready()
+		if err == nil {
+			logger.LogDebug(LOGTAG, "%s is ready", name)
+			return nil
+		}
+		select {
+		case exitErr := <-exited:
+			return errors.New(fmt.Sprintf("%s exited before becoming ready (%v), stderr:\n%s", name, exitErr, output))
+		default:
+		}
+		if time.Now().After(deadline) {
+			return errors.New(fmt.Sprintf("%s not ready after %s (%s), stderr:\n%s", name, timeout, err, output))
+		}
+		time.Sleep(READINESS_POLL_INTERVAL)
+	}
+}
+
+// checks the elasticsearch cluster health endpoint reports at least yellow
+func elasticReady() (err error) {
+	body, err := api.DoCommand("GET", "/_cluster/health", nil)
+	if err != nil {
+		return
+	}
+	var health struct {
+		Status string `json:"status"`
+	}
+	err = json.Unmarshal(body, &health)
+	if err != nil {
+		return
+	}
+	if health.Status != "green" && health.Status != "yellow" {
+		err = errors.New(fmt.Sprintf("cluster health is %q", health.Status))
+	}
+	return
+}
+
+// checks the luigi scheduler answers http requests
+func luigiReady() (err error) {
+	resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/", LUIGI_PORT))
+	if err != nil {
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		err = errors.New(fmt.Sprintf("luigid returned %s", resp.Status))
+	}
+	return
+}
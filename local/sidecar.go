@@ -0,0 +1,179 @@
+package local
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/ProtoML/ProtoML-persist/persist/elastic"
+	"github.com/ProtoML/ProtoML/logger"
+	"github.com/ProtoML/ProtoML/types"
+	"github.com/ProtoML/ProtoML/utils/osutils"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+const (
+	RECORD_SIDECAR_FILE = "record.json"
+	REINDEX_BATCH       = 500
+)
+
+// writes every metadata record as a json sidecar in its key directory,
+// so the metadata can be rebuilt from the state directory alone
+type recordSidecars struct {
+	store *LocalStorage
+}
+
+// ids are only unique within a namespace, so other namespaces keep their sidecars under their own key.
+// the default namespace uses the record key, where sidecars were written before namespaces existed.
+func SidecarKey(namespace, elastictype, elasticid string) string {
+	if len(namespace) == 0 {
+		return RecordKey(elastictype, elasticid)
+	}
+	return RecordKey(elastictype, elasticid) + "." + namespace
+}
+
+func (store *LocalStorage) sidecarPath(namespace, elastictype, elasticid string) string {
+	return store.getFilePath(SidecarKey(namespace, elastictype, elasticid), RECORD_SIDECAR_FILE)
+}
+
+func (sidecars recordSidecars) RecordWritten(record elastic.ExportedRecord) (err error) {
+	sidecarPath := sidecars.store.sidecarPath(record.Namespace, record.Type, record.Id)
+	err = osutils.TouchDir(path.Dir(sidecarPath))
+	if err != nil {
+		return
+	}
+	blob, err := json.Marshal(record)
+	if err != nil {
+		return
+	}
+	// write then rename so a sidecar is never left half written
+	file, err := osutils.TouchFile(sidecarPath + ".tmp")
+	if err != nil {
+		return
+	}
+	_, err = file.Write(blob)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return
+	}
+	return os.Rename(sidecarPath+".tmp", sidecarPath)
+}
+
+func (sidecars recordSidecars) RecordDeleted(namespace string, elastictype string, elasticid string) (err error) {
+	err = os.Remove(sidecars.store.sidecarPath(namespace, elastictype, elasticid))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return
+}
+
+// calls handle with every readable sidecar in the state directory and the path it was read from.
+// sidecars that are unreadable or not in the key directory of their record are skipped.
+func (store *LocalStorage) eachSidecar(handle func(sidecarPath string, record elastic.ExportedRecord) error) (err error) {
+	elasticDir := store.absoluteStoragePath(ELASTIC_DIRECTORY)
+	stagingDir := store.absoluteStoragePath(STAGING_DIRECTORY)
+	return filepath.Walk(store.stateDirectory(), func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if filePath == elasticDir || filePath == stagingDir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.Name() != RECORD_SIDECAR_FILE {
+			return nil
+		}
+		blob, err := osutils.LoadBlob(filePath)
+		if err != nil {
+			return err
+		}
+		var record elastic.ExportedRecord
+		if err = json.Unmarshal(blob, &record); err != nil {
+			logger.LogInfo(LOGTAG, "Skipping unreadable sidecar %s: %s", filePath, err)
+			return nil
+		}
+		// sidecars copied into the wrong key directory are not trusted
+		if filePath != store.sidecarPath(record.Namespace, record.Type, record.Id) {
+			logger.LogInfo(LOGTAG, "Skipping sidecar %s outside the key directory of %s id %s", filePath, record.Type, record.Id)
+			return nil
+		}
+		return handle(filePath, record)
+	})
+}
+
+// removes the sidecars of every record in a namespace
+func (store *LocalStorage) removeSidecars(namespace string) (err error) {
+	return store.eachSidecar(func(sidecarPath string, record elastic.ExportedRecord) error {
+		if record.Namespace != namespace {
+			return nil
+		}
+		return os.Remove(sidecarPath)
+	})
+}
+
+// rebuilds every metadata record of the current namespace from the sidecars in the state directory.
+// refuses to when a record in elasticsearch has no sidecar, since it would be lost.
+func (store *LocalStorage) Reindex() (count int, err error) {
+	namespace := elastic.CurrentNamespace()
+	logger.LogInfo(LOGTAG, "Reindexing metadata of namespace %q from %s", namespace, store.stateDirectory())
+	records := make([]elastic.ExportedRecord, 0)
+	found := make(map[string]bool)
+	err = store.eachSidecar(func(sidecarPath string, record elastic.ExportedRecord) error {
+		if record.Namespace != namespace {
+			return nil
+		}
+		// datatypes are keyed by name since schema version 2, older sidecars are stale duplicates
+		if record.Type == elastic.DATATYPE_TYPE {
+			var datatype types.DataType
+			if err := json.Unmarshal(record.Source, &datatype); err != nil || string(datatype.TypeName) != record.Id {
+				logger.LogInfo(LOGTAG, "Skipping stale datatype sidecar %s", sidecarPath)
+				return nil
+			}
+		}
+		records = append(records, record)
+		found[SidecarKey(record.Namespace, record.Type, record.Id)] = true
+		return nil
+	})
+	if err != nil {
+		return
+	}
+
+	missing := 0
+	err = elastic.ExportRecords(func(record elastic.ExportedRecord) error {
+		if !found[SidecarKey(record.Namespace, record.Type, record.Id)] {
+			logger.LogInfo(LOGTAG, "No sidecar for %s id %s", record.Type, record.Id)
+			missing++
+		}
+		return nil
+	})
+	if err != nil {
+		return
+	}
+	if missing > 0 {
+		err = errors.New(fmt.Sprintf("Refusing to reindex namespace %q, %d records have no sidecar and would be lost", namespace, missing))
+		return
+	}
+
+	err = elastic.ResetIndex()
+	if err != nil {
+		return
+	}
+	for start := 0; start < len(records); start += REINDEX_BATCH {
+		end := start + REINDEX_BATCH
+		if end > len(records) {
+			end = len(records)
+		}
+		err = elastic.ImportRecords(records[start:end])
+		if err != nil {
+			return
+		}
+		count = end
+	}
+	logger.LogInfo(LOGTAG, "Reindexed %d records", count)
+	return
+}
@@ -0,0 +1,475 @@
+package local
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/ProtoML/ProtoML-persist/persist/elastic"
+	"github.com/ProtoML/ProtoML/logger"
+	"github.com/ProtoML/ProtoML/utils/osutils"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	SNAPSHOT_MANIFEST     = "manifest.json"
+	SNAPSHOT_METADATA     = "metadata.json"
+	SNAPSHOT_STATE        = "state"
+	SNAPSHOT_BACKUP       = "backup"
+	SNAPSHOT_IMPORT_BATCH = 500
+)
+
+// describes a snapshot archive
+type SnapshotManifest struct {
+	Created time.Time
+	// the namespace in use when the snapshot was taken
+	Namespace string
+	// every namespace in the snapshot, empty for snapshots holding only Namespace
+	Namespaces     []string
+	SchemaVersion  int
+	StateDirectory string
+}
+
+// the namespaces whose metadata is in the snapshot
+func (manifest SnapshotManifest) snapshotNamespaces() []string {
+	if len(manifest.Namespaces) == 0 {
+		return []string{manifest.Namespace}
+	}
+	return manifest.Namespaces
+}
+
+// writes a single archive holding the metadata records of every namespace and the data files of the state directory,
+// which are shared by all namespaces.
+// transforms should not be running while the snapshot is taken.
+func (store *LocalStorage) Snapshot(snapshotPath string) (err error) {
+	logger.LogInfo(LOGTAG, "Writing snapshot to %s", snapshotPath)
+	file, err := os.Create(snapshotPath)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	gz := gzip.NewWriter(file)
+	archive := tar.NewWriter(gz)
+
+	namespaces, err := elastic.ListNamespaces()
+	if err != nil {
+		return
+	}
+	manifest := SnapshotManifest{
+		Created:        time.Now(),
+		Namespace:      elastic.CurrentNamespace(),
+		Namespaces:     namespaces,
+		SchemaVersion:  elastic.LatestSchemaVersion(),
+		StateDirectory: store.stateDirectory(),
+	}
+	manifestBlob, err := json.Marshal(manifest)
+	if err != nil {
+		return
+	}
+	err = writeArchiveBlob(archive, SNAPSHOT_MANIFEST, manifestBlob)
+	if err != nil {
+		return
+	}
+
+	// export metadata as one record per line
+	metadataFile, err := ioutil.TempFile("", "protoml-metadata")
+	if err != nil {
+		return
+	}
+	defer os.Remove(metadataFile.Name())
+	defer metadataFile.Close()
+	encoder := json.NewEncoder(metadataFile)
+	err = elastic.ExportAllRecords(func(record elastic.ExportedRecord) error {
+		return encoder.Encode(record)
+	})
+	if err != nil {
+		return
+	}
+	err = writeArchiveFile(archive, SNAPSHOT_METADATA, metadataFile.Name())
+	if err != nil {
+		return
+	}
+
+	// add data files, elasticsearch keeps its own data which is exported above
+	// and staging only holds ingestions that are not finished
+	elasticDir := store.absoluteStoragePath(ELASTIC_DIRECTORY)
+	stagingDir := store.absoluteStoragePath(STAGING_DIRECTORY)
+	err = filepath.Walk(store.stateDirectory(), func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if filePath == elasticDir || filePath == stagingDir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		relPath, err := filepath.Rel(store.stateDirectory(), filePath)
+		if err != nil {
+			return err
+		}
+		return writeArchiveFile(archive, path.Join(SNAPSHOT_STATE, filepath.ToSlash(relPath)), filePath)
+	})
+	if err != nil {
+		return
+	}
+
+	err = archive.Close()
+	if err != nil {
+		return
+	}
+	return gz.Close()
+}
+
+func writeArchiveBlob(archive *tar.Writer, name string, blob []byte) (err error) {
+	header := &tar.Header{Name: name, Mode: 0644, Size: int64(len(blob)), ModTime: time.Now()}
+	err = archive.WriteHeader(header)
+	if err != nil {
+		return
+	}
+	_, err = archive.Write(blob)
+	return
+}
+
+func writeArchiveFile(archive *tar.Writer, name string, filePath string) (err error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return
+	}
+	header, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return
+	}
+	header.Name = name
+	err = archive.WriteHeader(header)
+	if err != nil {
+		return
+	}
+	_, err = io.Copy(archive, file)
+	return
+}
+
+// replaces the metadata of every namespace and the data files of the state directory
+// with those of a snapshot, which may have been taken on another machine.
+// namespaces that are not in the snapshot are dropped, except the one in use which is left empty.
+// the previous data files and records are put back if the snapshot can't be restored.
+func (store *LocalStorage) Restore(snapshotPath string) (err error) {
+	logger.LogInfo(LOGTAG, "Restoring snapshot %s", snapshotPath)
+	file, err := os.Open(snapshotPath)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		return
+	}
+	defer gz.Close()
+	archive := tar.NewReader(gz)
+
+	// state files are unpacked into staging so a broken archive leaves the state directory untouched,
+	// and the replaced state is kept there until the snapshot is restored
+	restoreId, err := elastic.NewID()
+	if err != nil {
+		return
+	}
+	restoreDir := path.Join(store.absoluteStoragePath(STAGING_DIRECTORY), "restore-"+restoreId)
+	unpackDir := path.Join(restoreDir, SNAPSHOT_STATE)
+	backupDir := path.Join(restoreDir, SNAPSHOT_BACKUP)
+	store.beginStaging(path.Base(restoreDir))
+	defer store.endStaging(path.Base(restoreDir))
+	err = osutils.TouchDir(unpackDir)
+	if err != nil {
+		return
+	}
+	err = osutils.TouchDir(backupDir)
+	if err != nil {
+		return
+	}
+	keepRestoreDir := false
+	defer func() {
+		if !keepRestoreDir {
+			os.RemoveAll(restoreDir)
+		}
+	}()
+
+	// the manifest is written first, metadata is imported once the data files are in place
+	var manifest SnapshotManifest
+	var metadataPath string
+	defer func() {
+		if len(metadataPath) > 0 {
+			os.Remove(metadataPath)
+		}
+	}()
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		switch {
+		case header.Name == SNAPSHOT_MANIFEST:
+			err = json.NewDecoder(archive).Decode(&manifest)
+			if err != nil {
+				return err
+			}
+			if manifest.SchemaVersion > elastic.LatestSchemaVersion() {
+				return errors.New(fmt.Sprintf("Snapshot schema version %d is newer than supported version %d", manifest.SchemaVersion, elastic.LatestSchemaVersion()))
+			}
+		case header.Name == SNAPSHOT_METADATA:
+			metadataFile, err := ioutil.TempFile("", "protoml-metadata")
+			if err != nil {
+				return err
+			}
+			metadataPath = metadataFile.Name()
+			_, err = io.Copy(metadataFile, archive)
+			metadataFile.Close()
+			if err != nil {
+				return err
+			}
+		case strings.HasPrefix(header.Name, SNAPSHOT_STATE+"/"):
+			err = restoreStateFile(unpackDir, strings.TrimPrefix(header.Name, SNAPSHOT_STATE+"/"), header, archive)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if len(metadataPath) == 0 {
+		return errors.New(fmt.Sprintf("Snapshot %s has no metadata", snapshotPath))
+	}
+
+	// the records being replaced are exported so they can be put back
+	backupMetadata, err := ioutil.TempFile("", "protoml-metadata")
+	if err != nil {
+		return
+	}
+	defer os.Remove(backupMetadata.Name())
+	backupManifest := SnapshotManifest{Namespace: elastic.CurrentNamespace(), StateDirectory: store.stateDirectory()}
+	backupManifest.Namespaces, err = elastic.ListNamespaces()
+	if err == nil {
+		encoder := json.NewEncoder(backupMetadata)
+		err = elastic.ExportAllRecords(func(record elastic.ExportedRecord) error {
+			return encoder.Encode(record)
+		})
+	}
+	if closeErr := backupMetadata.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return
+	}
+
+	err = store.moveStateEntries(store.stateDirectory(), backupDir)
+	if err != nil {
+		// nothing was replaced yet, the entries already moved go straight back
+		if moveErr := store.moveStateEntries(backupDir, store.stateDirectory()); moveErr != nil {
+			keepRestoreDir = true
+			return errors.New(fmt.Sprintf("%s, and moving back the state files failed: %s. They are kept in %s", err, moveErr, backupDir))
+		}
+		return
+	}
+	err = store.moveStateEntries(unpackDir, store.stateDirectory())
+	if err == nil {
+		err = resetNamespaces(manifest.snapshotNamespaces())
+	}
+	if err == nil {
+		err = store.importMetadata(metadataPath, manifest)
+	}
+	if err != nil {
+		logger.LogInfo(LOGTAG, "Restoring snapshot %s failed, putting back the previous state: %s", snapshotPath, err)
+		if rollbackErr := store.rollbackRestore(backupDir, backupMetadata.Name(), backupManifest); rollbackErr != nil {
+			keepRestoreDir = true
+			return errors.New(fmt.Sprintf("%s, and putting back the previous state failed: %s. The previous state files are kept in %s", err, rollbackErr, backupDir))
+		}
+	}
+	return
+}
+
+// puts back the state files and records replaced by a restore that failed
+func (store *LocalStorage) rollbackRestore(backupDir string, backupMetadataPath string, backupManifest SnapshotManifest) (err error) {
+	err = store.clearStateEntries()
+	if err != nil {
+		return
+	}
+	err = store.moveStateEntries(backupDir, store.stateDirectory())
+	if err != nil {
+		return
+	}
+	err = resetNamespaces(backupManifest.Namespaces)
+	if err != nil {
+		return
+	}
+	return store.importMetadata(backupMetadataPath, backupManifest)
+}
+
+func restoreStateFile(restoreDir string, relPath string, header *tar.Header, content io.Reader) (err error) {
+	// refuse paths escaping the restore directory
+	target := filepath.Join(restoreDir, filepath.FromSlash(relPath))
+	if !strings.HasPrefix(target, filepath.Clean(restoreDir)+string(filepath.Separator)) {
+		return errors.New(fmt.Sprintf("Snapshot file %s is outside the state directory", relPath))
+	}
+	err = osutils.TouchDir(filepath.Dir(target))
+	if err != nil {
+		return
+	}
+	file, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(header.Mode).Perm())
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	_, err = io.Copy(file, content)
+	return
+}
+
+// moves the data files and sidecars from one directory into another, leaving elasticsearch and staging
+func (store *LocalStorage) moveStateEntries(fromDir, toDir string) (err error) {
+	entries, err := ioutil.ReadDir(fromDir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if entry.Name() == ELASTIC_DIRECTORY || entry.Name() == STAGING_DIRECTORY {
+			continue
+		}
+		if err = os.Rename(path.Join(fromDir, entry.Name()), path.Join(toDir, entry.Name())); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// removes the data files and sidecars of the state directory, leaving elasticsearch and staging
+func (store *LocalStorage) clearStateEntries() (err error) {
+	stateDir := store.stateDirectory()
+	entries, err := ioutil.ReadDir(stateDir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if entry.Name() == ELASTIC_DIRECTORY || entry.Name() == STAGING_DIRECTORY {
+			continue
+		}
+		if err = os.RemoveAll(path.Join(stateDir, entry.Name())); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// empties the snapshot namespaces and the one in use, dropping every other namespace
+// since its records would refer to data files that no longer exist
+func resetNamespaces(snapshotNamespaces []string) (err error) {
+	keep := map[string]bool{elastic.CurrentNamespace(): true}
+	for _, namespace := range snapshotNamespaces {
+		keep[namespace] = true
+	}
+	existing, err := elastic.ListNamespaces()
+	if err != nil {
+		return
+	}
+	for _, namespace := range existing {
+		if keep[namespace] {
+			continue
+		}
+		if err = elastic.DropNamespace(namespace); err != nil {
+			return
+		}
+	}
+	for namespace := range keep {
+		if err = elastic.ResetNamespace(namespace); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// imports exported records into their namespaces, moving data part paths from the snapshot state directory to this one.
+// records without a namespace are from snapshots of a single namespace.
+func (store *LocalStorage) importMetadata(metadataPath string, manifest SnapshotManifest) (err error) {
+	metadataFile, err := os.Open(metadataPath)
+	if err != nil {
+		return
+	}
+	defer metadataFile.Close()
+	decoder := json.NewDecoder(bufio.NewReader(metadataFile))
+	batches := make(map[string][]elastic.ExportedRecord)
+	for _, namespace := range manifest.snapshotNamespaces() {
+		batches[namespace] = make([]elastic.ExportedRecord, 0, SNAPSHOT_IMPORT_BATCH)
+	}
+	for {
+		var record elastic.ExportedRecord
+		err = decoder.Decode(&record)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return
+		}
+		if len(record.Namespace) == 0 {
+			record.Namespace = manifest.Namespace
+		}
+		if _, ok := batches[record.Namespace]; !ok {
+			return errors.New(fmt.Sprintf("Snapshot record %s %s is in namespace %q missing from the manifest", record.Type, record.Id, record.Namespace))
+		}
+		if record.Type == elastic.DATAPARTS_TYPE && manifest.StateDirectory != store.stateDirectory() {
+			record.Source, err = relocateDataParts(record.Source, manifest.StateDirectory, store.stateDirectory())
+			if err != nil {
+				return
+			}
+		}
+		batches[record.Namespace] = append(batches[record.Namespace], record)
+		if len(batches[record.Namespace]) == SNAPSHOT_IMPORT_BATCH {
+			if err = elastic.ImportNamespaceRecords(record.Namespace, batches[record.Namespace]); err != nil {
+				return
+			}
+			batches[record.Namespace] = batches[record.Namespace][:0]
+		}
+	}
+	for namespace, batch := range batches {
+		if err = elastic.ImportNamespaceRecords(namespace, batch); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// rewrites the column paths of a dataparts source that are under fromDir to be under toDir,
+// leaving every other field, such as the creation time, as it is
+func relocateDataParts(source json.RawMessage, fromDir, toDir string) (relocated json.RawMessage, err error) {
+	var parts map[string]json.RawMessage
+	err = json.Unmarshal(source, &parts)
+	if err != nil {
+		return
+	}
+	var colPaths []string
+	if colPathsJSON, ok := parts["ColPaths"]; ok {
+		if err = json.Unmarshal(colPathsJSON, &colPaths); err != nil {
+			return
+		}
+	}
+	prefix := filepath.Clean(fromDir) + string(filepath.Separator)
+	for i, colPath := range colPaths {
+		if strings.HasPrefix(colPath, prefix) {
+			colPaths[i] = filepath.Join(toDir, strings.TrimPrefix(colPath, prefix))
+		}
+	}
+	if parts["ColPaths"], err = json.Marshal(colPaths); err != nil {
+		return
+	}
+	return json.Marshal(parts)
+}
@@ -0,0 +1,34 @@
+package local
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestRelocateDataParts(t *testing.T) {
+	source := json.RawMessage(`{"ParentGroupId": "dg1", "Created": 1381000000000, "ColPaths": ["/a/.ProtoML/0a1b/0000000000.csv", "/a/.ProtoML2/0a1b/0000000001.csv"]}`)
+	relocated, err := relocateDataParts(source, "/a/.ProtoML", "/b/.ProtoML")
+	if err != nil {
+		t.Fatalf("relocateDataParts returned error: %s", err)
+	}
+	var parts struct {
+		ParentGroupId string
+		Created       int64
+		ColPaths      []string
+	}
+	if err = json.Unmarshal(relocated, &parts); err != nil {
+		t.Fatalf("relocateDataParts returned bad json: %s", err)
+	}
+	if parts.ParentGroupId != "dg1" || parts.Created != 1381000000000 {
+		t.Errorf("relocateDataParts dropped fields: %s", relocated)
+	}
+	want := []string{"/b/.ProtoML/0a1b/0000000000.csv", "/a/.ProtoML2/0a1b/0000000001.csv"}
+	if len(parts.ColPaths) != len(want) {
+		t.Fatalf("relocateDataParts ColPaths = %v, want %v", parts.ColPaths, want)
+	}
+	for i := range want {
+		if parts.ColPaths[i] != want[i] {
+			t.Errorf("relocateDataParts ColPaths[%d] = %s, want %s", i, parts.ColPaths[i], want[i])
+		}
+	}
+}
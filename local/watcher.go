@@ -0,0 +1,170 @@
+package local
+
+import (
+	"github.com/ProtoML/ProtoML-persist/persist/elastic"
+	"github.com/ProtoML/ProtoML/logger"
+	"github.com/ProtoML/ProtoML/utils"
+	"github.com/ProtoML/ProtoML/utils/osutils"
+	"github.com/fsnotify/fsnotify"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	WATCHER_LOGTAG          = "TransformWatcher"
+	TRANSFORM_POLL_INTERVAL = time.Second * 5
+)
+
+// the ProtoML-transforms directory and every external transform directory
+func (store *LocalStorage) transformDirectories() (dirs []string) {
+	dirs = make([]string, 0)
+	if protomlDir, err := utils.ProtoMLDir(); err == nil {
+		dirs = append(dirs, path.Join(protomlDir, PROTOML_TRANSFORMS_DIRECTORY))
+	}
+	for _, dir := range filepath.SplitList(store.Config.ExternalTransformDirectories) {
+		if len(dir) > 0 {
+			dirs = append(dirs, dir)
+		}
+	}
+	return
+}
+
+func isTransformFile(file string) bool {
+	return strings.HasSuffix(file, ".json")
+}
+
+// registers a new or changed template file, adding a new version when its contents changed
+func (store *LocalStorage) reloadTransformFile(transformFile string) {
+	_, transformID, err := store.AddTransformFile(transformFile)
+	if err != nil {
+		logger.LogInfo(WATCHER_LOGTAG, "Could not reload transform %s: %s", transformFile, err)
+		return
+	}
+	logger.LogDebug(WATCHER_LOGTAG, "Reloaded transform %s as %s", transformFile, transformID)
+}
+
+// flags the transforms of a deleted template file as removed
+func (store *LocalStorage) removeTransformFile(transformFile string) {
+	ids, err := elastic.SetTransformTemplateRemoved(transformFile, true)
+	if err != nil {
+		logger.LogInfo(WATCHER_LOGTAG, "Could not flag removed transform %s: %s", transformFile, err)
+		return
+	}
+	logger.LogDebug(WATCHER_LOGTAG, "Flagged transforms %v from %s as removed", ids, transformFile)
+}
+
+// starts watching the transform directories for added, changed and removed templates.
+// uses inotify where possible and falls back to polling.
+func (store *LocalStorage) WatchTransforms() (err error) {
+	if store.TransformWatcherDone != nil {
+		return
+	}
+	dirs := store.transformDirectories()
+	store.TransformWatcherDone = make(chan bool)
+
+	watcher, err := fsnotify.NewWatcher()
+	if err == nil {
+		for _, dir := range dirs {
+			// missing directories were already reported at Init
+			if !osutils.PathExists(dir) {
+				continue
+			}
+			if err = watcher.Add(dir); err != nil {
+				break
+			}
+		}
+		if err == nil {
+			logger.LogInfo(WATCHER_LOGTAG, "Watching transform directories %v", dirs)
+			go store.notifyTransforms(watcher, store.TransformWatcherDone)
+			return
+		}
+		watcher.Close()
+	}
+	logger.LogInfo(WATCHER_LOGTAG, "Falling back to polling transform directories %v: %s", dirs, err)
+	go store.pollTransforms(dirs, store.TransformWatcherDone)
+	return nil
+}
+
+func (store *LocalStorage) StopWatchingTransforms() {
+	if store.TransformWatcherDone != nil {
+		close(store.TransformWatcherDone)
+		store.TransformWatcherDone = nil
+	}
+}
+
+func (store *LocalStorage) notifyTransforms(watcher *fsnotify.Watcher, done chan bool) {
+	defer watcher.Close()
+	for {
+		select {
+		case <-done:
+			return
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if !isTransformFile(event.Name) {
+				continue
+			}
+			if event.Op&(fsnotify.Remove|fsnotify.Rename) != 0 {
+				store.removeTransformFile(event.Name)
+			} else if event.Op&(fsnotify.Create|fsnotify.Write) != 0 {
+				store.reloadTransformFile(event.Name)
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			logger.LogInfo(WATCHER_LOGTAG, "Watch error: %s", err)
+		}
+	}
+}
+
+// modification times of every template file in dirs
+func scanTransformFiles(dirs []string) (modTimes map[string]time.Time) {
+	modTimes = make(map[string]time.Time)
+	for _, dir := range dirs {
+		files, err := osutils.ListFilesInDirectory(dir)
+		if err != nil {
+			continue
+		}
+		for _, file := range files {
+			if !isTransformFile(file) {
+				continue
+			}
+			info, err := os.Stat(path.Join(dir, file))
+			if err != nil || info.IsDir() {
+				continue
+			}
+			modTimes[path.Join(dir, file)] = info.ModTime()
+		}
+	}
+	return
+}
+
+func (store *LocalStorage) pollTransforms(dirs []string, done chan bool) {
+	known := scanTransformFiles(dirs)
+	ticker := time.NewTicker(TRANSFORM_POLL_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			current := scanTransformFiles(dirs)
+			for file, modTime := range current {
+				if last, ok := known[file]; !ok || !last.Equal(modTime) {
+					store.reloadTransformFile(file)
+				}
+			}
+			for file := range known {
+				if _, ok := current[file]; !ok {
+					store.removeTransformFile(file)
+				}
+			}
+			known = current
+		}
+	}
+}
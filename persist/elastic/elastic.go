@@ -2,12 +2,18 @@ package elastic
 
 import (
 	"github.com/ProtoML/ProtoML/types"
+	"github.com/mattbaird/elastigo/api"
 	"github.com/mattbaird/elastigo/core"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"sort"
+	"time"
 	"errors"
 	"fmt"
 	"encoding/json"
 	"github.com/ProtoML/ProtoML/logger"
-	"time"
+	"github.com/ProtoML/ProtoML/utils/osutils"
 )
 
 const (
@@ -19,6 +25,10 @@ const (
 	TRANSFORM_TYPE                = "transform"
 	INDUCED_TRANSFORM_TYPE        = "itransform"
 	STATE_TYPE                    = "state"
+	DATAPARTS_TYPE                = "dataparts"
+	// fields added to the source of records
+	CREATED_FIELD                 = "Created"
+	STATUS_FIELD                  = "Status"
 )
 
 func ElasticSearchError(res core.SearchResult, errormsg string) (err error) {
@@ -35,16 +45,200 @@ func ElasticSearchError(res core.SearchResult, errormsg string) (err error) {
 
 
 func ElasticIndex(elastictype string, data interface{}, eid string) (id string, err error) {
+	return elasticIndexWithOp(elastictype, data, eid, "create")
+}
+
+func elasticIndexWithOp(elastictype string, data interface{}, eid string, opType string) (id string, err error) {
+	// overwritten records keep their creation time
+	created := toMillis(time.Now())
+	if opType == "index" && len(eid) > 0 {
+		if existing, ok := existingCreated(elastictype, eid); ok {
+			created = existing
+		}
+	}
+	source, err := stampSource(elastictype, data, created)
+	if err != nil {
+		return
+	}
 	// index 
-	resp, err := core.IndexWithParameters(true, PROTOML_INDEX, elastictype, eid, "", 0, "create", "", "", 0, "", "", false, data) 
+	// refresh so the write is visible to searches as soon as it returns
+	resp, err := core.IndexWithParameters(true, currentIndex, elastictype, eid, "", 0, opType, "", "", 0, "", "", true, source) 
 	if err != nil {
 		return
 	}
 	if !resp.Ok {
 		err = errors.New(fmt.Sprintf("elastic addtion of type %s failed", elastictype))
+		return
 	}
-	time.Sleep(time.Second) // sleep to allow for elasticsearch indexing
 	id = resp.Id
+	if recordObserver != nil {
+		err = recordObserver.RecordWritten(ExportedRecord{currentNamespace, elastictype, id, source})
+	}
+	return
+}
+
+func toMillis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+// adds the creation time in milliseconds, unless the record has one, to the source of a record.
+// induced transforms also get their validation status. Both are kept in the source so they
+// survive migrations, restores and reindexing.
+func stampSource(elastictype string, data interface{}, created int64) (source json.RawMessage, err error) {
+	blob, err := json.Marshal(data)
+	if err != nil {
+		return
+	}
+	fields := make(map[string]json.RawMessage)
+	if err = json.Unmarshal(blob, &fields); err != nil {
+		return
+	}
+	if _, ok := fields[CREATED_FIELD]; !ok {
+		if fields[CREATED_FIELD], err = json.Marshal(created); err != nil {
+			return
+		}
+	}
+	if elastictype == INDUCED_TRANSFORM_TYPE {
+		var itransform struct {
+			Error string
+		}
+		if err = json.Unmarshal(blob, &itransform); err != nil {
+			return
+		}
+		status := STATUS_VALID
+		if len(itransform.Error) > 0 {
+			status = STATUS_INVALID
+		}
+		if fields[STATUS_FIELD], err = json.Marshal(status); err != nil {
+			return
+		}
+	}
+	return json.Marshal(fields)
+}
+
+// the creation time of a stored record
+func existingCreated(elastictype string, elasticid string) (created int64, ok bool) {
+	res, err := core.Get(true, currentIndex, elastictype, elasticid)
+	if err != nil || (!res.Found && !res.Exists) {
+		return
+	}
+	var record struct {
+		Created int64
+	}
+	if err = decodeSource(res.Source, &record); err != nil || record.Created == 0 {
+		return
+	}
+	return record.Created, true
+}
+
+type bulkItemResult struct {
+	Id     string `json:"_id"`
+	Ok     bool   `json:"ok"`
+	Status int    `json:"status"`
+	Error  interface{} `json:"error"`
+}
+
+type bulkResult struct {
+	Items []map[string]bulkItemResult `json:"items"`
+}
+
+// posts a refreshing bulk request of n actions, failing when any action failed.
+// elasticsearch applies the other actions of a request that fails.
+func bulkRequest(body string, n int, operation string) (results []bulkItemResult, err error) {
+	resp, err := api.DoCommand("POST", "/_bulk?refresh=true", body)
+	if err != nil {
+		return
+	}
+	var result bulkResult
+	err = json.Unmarshal(resp, &result)
+	if err != nil {
+		return
+	}
+	if len(result.Items) != n {
+		err = errors.New(fmt.Sprintf("elastic bulk %s returned %d of %d results", operation, len(result.Items), n))
+		return
+	}
+	results = make([]bulkItemResult, n)
+	failed := 0
+	for i, item := range result.Items {
+		for _, itemResult := range item {
+			if itemResult.Error != nil {
+				if failed == 0 {
+					err = errors.New(fmt.Sprintf("elastic bulk %s failed for id %s: %v", operation, itemResult.Id, itemResult.Error))
+				}
+				failed++
+			}
+			results[i] = itemResult
+		}
+	}
+	if failed > 1 {
+		err = errors.New(fmt.Sprintf("%s, and %d more failures", err, failed-1))
+	}
+	return
+}
+
+// a random id for records whose id must be known before they are written
+func NewID() (id string, err error) {
+	buf := make([]byte, 16)
+	_, err = rand.Read(buf)
+	if err != nil {
+		return
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// adds many records of one type in a single refreshing bulk request
+func ElasticBulkAdd(elastictype string, data []interface{}) (ids []string, err error) {
+	return ElasticBulkAddWithIds(elastictype, nil, data)
+}
+
+// adds many records of one type with the given ids, or generated ids if ids is nil
+func ElasticBulkAddWithIds(elastictype string, eids []string, data []interface{}) (ids []string, err error) {
+	ids = make([]string, len(data))
+	if len(data) == 0 {
+		return
+	}
+	if eids != nil && len(eids) != len(data) {
+		err = errors.New(fmt.Sprintf("elastic bulk addition of type %s given %d ids for %d records", elastictype, len(eids), len(data)))
+		return
+	}
+	var body bytes.Buffer
+	created := toMillis(time.Now())
+	sources := make([]json.RawMessage, len(data))
+	for i, record := range data {
+		target := map[string]string{"_index": currentIndex, "_type": elastictype}
+		if eids != nil {
+			target["_id"] = eids[i]
+		}
+		action, err := json.Marshal(map[string]interface{}{"create": target})
+		if err != nil {
+			return ids, err
+		}
+		source, err := stampSource(elastictype, record, created)
+		if err != nil {
+			return ids, err
+		}
+		sources[i] = source
+		body.Write(action)
+		body.WriteByte('\n')
+		body.Write(source)
+		body.WriteByte('\n')
+	}
+
+	results, err := bulkRequest(body.String(), len(data), fmt.Sprintf("addition of type %s", elastictype))
+	if err != nil {
+		return
+	}
+	for i, result := range results {
+		ids[i] = result.Id
+	}
+	if recordObserver != nil {
+		for i, id := range ids {
+			if err = recordObserver.RecordWritten(ExportedRecord{currentNamespace, elastictype, id, sources[i]}); err != nil {
+				return
+			}
+		}
+	}
 	return
 }
 
@@ -53,42 +247,167 @@ func ElasticAdd(elastictype string, data interface{}) (id string, err error) {
 }
 
 func ElasticUpdate(elastictype string, elasticid string, data interface{}) (err error) { 
-	_, err = ElasticIndex(elastictype, data, elasticid)
+	// overwrite the existing document, create would reject it
+	_, err = elasticIndexWithOp(elastictype, data, elasticid, "index")
 	return
 }
 
 func ElasticDelete(elastictype string, elasticid string) (err error) { 
-	_, err = core.Delete(true, PROTOML_INDEX, elastictype, elasticid, 0, "")
+	_, err = core.Delete(true, currentIndex, elastictype, elasticid, 0, "")
+	if err == nil && recordObserver != nil {
+		err = recordObserver.RecordDeleted(currentNamespace, elastictype, elasticid)
+	}
 	return
 }
 
-func ElasticGetAll(elastictype string) (ids []string, err error) {
-	// search 
-	res, err := core.SearchRequest(true, PROTOML_INDEX, elastictype, "", "", 0)
+// returned when a record of a type does not exist
+type NotFoundError struct {
+	Type string
+	Id string
+}
+
+func (e NotFoundError) Error() string {
+	return fmt.Sprintf("Can't find %s id %s", e.Type, e.Id)
+}
+
+func IsNotFound(err error) bool {
+	_, ok := err.(NotFoundError)
+	return ok
+}
+
+// decodes the generic source of a get response into a typed record
+func decodeSource(source interface{}, record interface{}) (err error) {
+	blob, err := json.Marshal(source)
 	if err != nil {
 		return
 	}
-	err = ElasticSearchError(res, fmt.Sprintf("%s ", elastictype))
+	return json.Unmarshal(blob, record)
+}
+
+// gets a record by id and decodes it into record, which must be a pointer to the record struct
+func ElasticGet(elastictype string, elasticid string, record interface{}) (err error) {
+	res, err := core.Get(true, currentIndex, elastictype, elasticid)
+	if err != nil {
+		return
+	}
+	if !res.Found && !res.Exists {
+		return NotFoundError{elastictype, elasticid}
+	}
+	err = decodeSource(res.Source, record)
+	if err != nil {
+		err = errors.New(fmt.Sprintf("Can't decode %s id %s: %s", elastictype, elasticid, err))
+	}
+	return
+}
+
+func ElasticExists(elastictype string, elasticid string) (exists bool, err error) {
+	res, err := core.Get(true, currentIndex, elastictype, elasticid)
 	if err != nil {
 		return
 	}
+	return res.Found || res.Exists, nil
+}
 
-	hits := res.Hits.Hits
-	ids = make([]string,len(hits))
-	for i, hit := range hits {
-		ids[i] = hit.Id
+func ElasticSearch(elastictype string, query interface{}) (res core.SearchResult, err error) {
+	res, err = core.SearchRequest(true, currentIndex, elastictype, query, "", 0)
+	if err != nil {
+		return
 	}
+	err = ElasticSearchError(res, fmt.Sprintf("%s ", elastictype))
+	return
+}
+
+// calls handle with every page of records of a type, however many there are
+func ElasticScroll(elastictype string, handle func(hits []core.Hit) error) (err error) {
+	return scrollIndex(currentIndex, elastictype, nil, handle)
+}
+
+// calls handle with every page of records of a type matching query
+func ElasticScrollQuery(elastictype string, query map[string]interface{}, handle func(hits []core.Hit) error) (err error) {
+	return scrollIndex(currentIndex, elastictype, query, handle)
+}
+
+// calls handle with the id of every record of a type
+func ElasticEachId(elastictype string, handle func(id string) error) (err error) {
+	return ElasticScroll(elastictype, func(hits []core.Hit) error {
+		for _, hit := range hits {
+			if err := handle(hit.Id); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// calls handle with every record of a type decoded into a new record from newRecord
+func ElasticEach(elastictype string, newRecord func() interface{}, handle func(id string, record interface{}) error) (err error) {
+	return ElasticScroll(elastictype, func(hits []core.Hit) error {
+		for _, hit := range hits {
+			record := newRecord()
+			if err := json.Unmarshal(hit.Source, record); err != nil {
+				return errors.New(fmt.Sprintf("Can't decode %s id %s: %s", elastictype, hit.Id, err))
+			}
+			if err := handle(hit.Id, record); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func ElasticGetAll(elastictype string) (ids []string, err error) {
+	ids = make([]string, 0)
+	err = ElasticEachId(elastictype, func(id string) error {
+		ids = append(ids, id)
+		return nil
+	})
 	return 
 }
 
+func EachDataType(handle func(id string, datatype types.DataType) error) (err error) {
+	return ElasticEach(DATATYPE_TYPE, func() interface{} { return &types.DataType{} }, func(id string, record interface{}) error {
+		return handle(id, *record.(*types.DataType))
+	})
+}
+
+func EachDataGroup(handle func(id string, datagroup types.DataGroup) error) (err error) {
+	return ElasticEach(DATAGROUP_TYPE, func() interface{} { return &types.DataGroup{} }, func(id string, record interface{}) error {
+		return handle(id, *record.(*types.DataGroup))
+	})
+}
+
+func EachTransformRecord(handle func(id string, record TransformRecord) error) (err error) {
+	return ElasticEach(TRANSFORM_TYPE, func() interface{} { return &TransformRecord{} }, func(id string, record interface{}) error {
+		return handle(id, *record.(*TransformRecord))
+	})
+}
+
+func EachInducedTransform(handle func(id string, itransform types.InducedTransform) error) (err error) {
+	return ElasticEach(INDUCED_TRANSFORM_TYPE, func() interface{} { return &types.InducedTransform{} }, func(id string, record interface{}) error {
+		return handle(id, *record.(*types.InducedTransform))
+	})
+}
+
+func EachState(handle func(id string, state types.State) error) (err error) {
+	return ElasticEach(STATE_TYPE, func() interface{} { return &types.State{} }, func(id string, record interface{}) error {
+		return handle(id, *record.(*types.State))
+	})
+}
+
 func GetDataType(name types.DataTypeName) (datatype types.DataType, err error) {
 	// search 
-	res, err := core.SearchUri(PROTOML_INDEX, DATATYPE_TYPE, fmt.Sprintf("TypeName=%s",name), "", 0)
+	query := map[string]interface{}{
+		"query": map[string]interface{}{
+			"term": map[string]interface{}{"TypeName": name},
+		},
+	}
+	res, err := ElasticSearch(DATATYPE_TYPE, query)
 	if err != nil {
 		return
 	}
-	err = ElasticSearchError(res, fmt.Sprintf("datatype %s",name))
-	if err != nil {
+
+	if len(res.Hits.Hits) == 0 {
+		err = NotFoundError{DATATYPE_TYPE, string(name)}
 		return
 	}
 
@@ -98,7 +417,38 @@ func GetDataType(name types.DataTypeName) (datatype types.DataType, err error) {
 	return
 }
 
+// whether two datatypes have the same parents, in any order
+func sameParentTypes(a, b types.DataType) bool {
+	if len(a.ParentTypes) != len(b.ParentTypes) {
+		return false
+	}
+	parents := make(map[types.DataTypeName]bool)
+	for _, parent := range a.ParentTypes {
+		parents[parent] = true
+	}
+	for _, parent := range b.ParentTypes {
+		if !parents[parent] {
+			return false
+		}
+	}
+	return true
+}
+
+// adds a datatype keyed by its name. Registering a datatype again with the same parents is a no-op,
+// while registering a name again with other parents is rejected.
 func AddDataType(datatype types.DataType) (id string, err error) {
+	id = string(datatype.TypeName)
+	existing, err := GetDataType(datatype.TypeName)
+	if err == nil {
+		if !sameParentTypes(existing, datatype) {
+			err = errors.New(fmt.Sprintf("Datatype %s is already registered with parents %v, not %v", datatype.TypeName, existing.ParentTypes, datatype.ParentTypes))
+			return
+		}
+		logger.LogDebug(LOGTAG,"DataType named %s already registered", datatype.TypeName)
+		return id, nil
+	} else if !IsNotFound(err) {
+		return
+	}
 	logger.LogDebug(LOGTAG,"Adding DataType named %s", datatype.TypeName)
 	// validate parents exist
 	for _, parent := range datatype.ParentTypes {
@@ -106,7 +456,7 @@ func AddDataType(datatype types.DataType) (id string, err error) {
 			return id, err
 		}
 	}
-	return ElasticAdd(DATATYPE_TYPE, datatype)
+	return ElasticIndex(DATATYPE_TYPE, datatype, id)
 }
 
 func GetDataTypeAncestors(name types.DataTypeName) (ancestorTypes []types.DataTypeName, err error) {
@@ -146,26 +496,71 @@ func AddDataGroup(datagroup types.DataGroup) (id string, err error) {
 	if _, err := GetDataType(datagroup.Columns.ExclusiveType); err != nil {
 		return id, err
 	}
-	return ElasticAdd(DATAGROUP_TYPE, datagroup)
+	// stored as a record without column tags so searches decode it like any other datagroup
+	return ElasticAdd(DATAGROUP_TYPE, DataGroupRecord{datagroup, []string{}, [][]string{}})
 }
 
-func GetDataGroup(id string) (datagroup types.DataGroup, err error) {
-	// search 
-	res, err := core.Get(true, PROTOML_INDEX, DATAGROUP_TYPE, id)
-	if err != nil {
-		return
-	}
-	if !res.Ok {
-		err = errors.New(fmt.Sprintf("elastic get failed on datagroup id %s",id))
-		return
+// a datagroup as stored in elasticsearch with the dataset tags of its columns
+type DataGroupRecord struct {
+	types.DataGroup
+	// every tag of any column
+	Tags []string
+	// tags of each column in datagroup order
+	ColumnTags [][]string
+}
+
+// the union of the tags of every column
+func unionTags(columnTags [][]string) (tags []string) {
+	seen := make(map[string]bool)
+	tags = make([]string, 0)
+	for _, colTags := range columnTags {
+		for _, tag := range colTags {
+			if !seen[tag] {
+				seen[tag] = true
+				tags = append(tags, tag)
+			}
+		}
 	}
-	if !res.Found {
-		err = errors.New(fmt.Sprintf("Can't find datagroup id %s",id))
-		return
+	sort.Strings(tags)
+	return
+}
+
+// adds datagroups in bulk, columnTags[i] holds the tags of each column of datagroups[i]
+func AddDataGroups(datagroups []types.DataGroup, columnTags [][][]string) (ids []string, err error) {
+	return AddDataGroupsWithIds(nil, datagroups, columnTags)
+}
+
+// adds datagroups in bulk with the given ids, or generated ids if ids is nil
+func AddDataGroupsWithIds(eids []string, datagroups []types.DataGroup, columnTags [][][]string) (ids []string, err error) {
+	logger.LogDebug(LOGTAG,"Adding %d DataGroups", len(datagroups))
+	data := make([]interface{}, len(datagroups))
+	checked := make(map[types.DataTypeName]bool)
+	for i, datagroup := range datagroups {
+		// validate column type exists
+		if !checked[datagroup.Columns.ExclusiveType] {
+			if _, err := GetDataType(datagroup.Columns.ExclusiveType); err != nil {
+				return ids, err
+			}
+			checked[datagroup.Columns.ExclusiveType] = true
+		}
+		record := DataGroupRecord{datagroup, []string{}, [][]string{}}
+		if i < len(columnTags) && columnTags[i] != nil {
+			record.ColumnTags = columnTags[i]
+			record.Tags = unionTags(columnTags[i])
+		}
+		data[i] = record
 	}
+	return ElasticBulkAddWithIds(DATAGROUP_TYPE, eids, data)
+}
+
+func GetDataGroupRecord(id string) (record DataGroupRecord, err error) {
+	err = ElasticGet(DATAGROUP_TYPE, id, &record)
+	return
+}
 
-	datagroup = res.Source.(types.DataGroup)
-	return	
+func GetDataGroup(id string) (datagroup types.DataGroup, err error) {
+	err = ElasticGet(DATAGROUP_TYPE, id, &datagroup)
+	return
 }
 
 func UpdateDataGroup(eid string, datagroup types.DataGroup) (err error) {
@@ -174,7 +569,13 @@ func UpdateDataGroup(eid string, datagroup types.DataGroup) (err error) {
 	if _, err := GetDataType(datagroup.Columns.ExclusiveType); err != nil {
 		return err
 	}
-	return ElasticUpdate(DATAGROUP_TYPE, eid, datagroup)
+	// the column tags are kept, SelectColumnsByTag would otherwise stop finding the datagroup
+	record, err := GetDataGroupRecord(eid)
+	if err != nil {
+		return
+	}
+	record.DataGroup = datagroup
+	return ElasticUpdate(DATAGROUP_TYPE, eid, record)
 }
 
 func AddTransform(transform types.Transform) (id string, err error) {
@@ -183,22 +584,219 @@ func AddTransform(transform types.Transform) (id string, err error) {
 	return ElasticAdd(TRANSFORM_TYPE, transform)
 }
 
-func GetTransform(id string) (transform types.Transform, err error) {
-	// search 
-	res, err := core.Get(true, PROTOML_INDEX, TRANSFORM_TYPE, id)
+// a dataset file as stored in elasticsearch, identified by the hash of its contents and schema
+type DatasetFileRecord struct {
+	types.DatasetFile
+	// the datagroups the dataset file was split into
+	DataIds []string
+}
+
+func AddDatasetFileRecord(contentHash string, record DatasetFileRecord) (err error) {
+	logger.LogDebug(LOGTAG,"Adding Dataset File %s with content hash %s", record.Path, contentHash)
+	_, err = ElasticIndex(DATAFILE_TYPE, record, contentHash)
+	return
+}
+
+func GetDatasetFileRecord(contentHash string) (record DatasetFileRecord, err error) {
+	err = ElasticGet(DATAFILE_TYPE, contentHash, &record)
+	return
+}
+
+// gets the dataset file a datagroup was split from
+func GetDatasetFileRecordByDataId(dataId string) (record DatasetFileRecord, contentHash string, err error) {
+	query := map[string]interface{}{
+		"query": map[string]interface{}{
+			"term": map[string]interface{}{"DataIds": dataId},
+		},
+		"size": 1,
+	}
+	res, err := ElasticSearch(DATAFILE_TYPE, query)
 	if err != nil {
 		return
 	}
-	if !res.Ok {
-		err = errors.New(fmt.Sprintf("elastic get failed on induced transform id %s",id))
+	if len(res.Hits.Hits) == 0 {
+		err = NotFoundError{DATAFILE_TYPE, dataId}
 		return
 	}
-	if !res.Found {
-		err = errors.New(fmt.Sprintf("Can't find induced transform id %s",id))
+	hit := res.Hits.Hits[0]
+	err = json.Unmarshal(hit.Source, &record)
+	contentHash = hit.Id
+	return
+}
+
+// gets every dataset file ingested from a path, keyed by content hash
+func GetDatasetFileRecordsByPath(datasetPath string) (records map[string]DatasetFileRecord, err error) {
+	records = make(map[string]DatasetFileRecord)
+	query := map[string]interface{}{
+		"query": map[string]interface{}{
+			"term": map[string]interface{}{"Path": datasetPath},
+		},
+	}
+	err = ElasticScrollQuery(DATAFILE_TYPE, query, func(hits []core.Hit) error {
+		for _, hit := range hits {
+			var record DatasetFileRecord
+			if err := json.Unmarshal(hit.Source, &record); err != nil {
+				return err
+			}
+			records[hit.Id] = record
+		}
+		return nil
+	})
+	return
+}
+
+// a transform as stored in elasticsearch, identified by its name and the hash of its template contents
+type TransformRecord struct {
+	types.Transform
+	ContentHash string
+	Version int
+	// the template file was deleted from its transform directory
+	Removed bool
+}
+
+// the elastic id of a transform version
+func TransformID(name, contentHash string) string {
+	return osutils.MD5Hash(fmt.Sprintf("%s:%s", name, contentHash))
+}
+
+// adds a transform keyed by name and content hash. Registering identical contents again is a no-op,
+// while changed contents are added as the next version of the transform name.
+func AddTransformVersion(transform types.Transform, contentHash string) (id string, created bool, err error) {
+	id = TransformID(transform.Name, contentHash)
+	exists, err := ElasticExists(TRANSFORM_TYPE, id)
+	if err != nil {
+		return
+	}
+	if exists {
+		logger.LogDebug(LOGTAG,"Transform %s from file %s already registered as %s", transform.Name, transform.Template, id)
+		record, err := GetTransformRecord(id)
+		if err != nil {
+			return id, false, err
+		}
+		// restored template files clear their removal flag
+		if record.Removed {
+			record.Removed = false
+			record.Template = transform.Template
+			err = ElasticUpdate(TRANSFORM_TYPE, id, record)
+		}
+		return id, false, err
+	}
+
+	version := 1
+	// removed versions keep their numbers
+	latest, _, err := latestTransformRecord(transform.Name, true)
+	if err == nil {
+		version = latest.Version + 1
+	} else if !IsNotFound(err) {
 		return
 	}
+	logger.LogDebug(LOGTAG,"Adding Transform %s version %d from file %s", transform.Name, version, transform.Template)
+	record := TransformRecord{transform, contentHash, version, false}
+	_, err = ElasticIndex(TRANSFORM_TYPE, record, id)
+	if err != nil {
+		return
+	}
+	return id, true, nil
+}
 
-	transform = res.Source.(types.Transform)
+// gets the latest version of a transform by name whose template file was not removed
+func GetTransformRecordByName(name string) (record TransformRecord, id string, err error) {
+	return latestTransformRecord(name, false)
+}
+
+// gets the latest version of a transform by name, including removed versions when includeRemoved is set
+func latestTransformRecord(name string, includeRemoved bool) (record TransformRecord, id string, err error) {
+	filter := map[string]interface{}{
+		"must": []interface{}{
+			map[string]interface{}{"term": map[string]interface{}{"Name": name}},
+		},
+	}
+	if !includeRemoved {
+		// records from before removal flags have no Removed field
+		filter["must_not"] = []interface{}{
+			map[string]interface{}{"term": map[string]interface{}{"Removed": true}},
+		}
+	}
+	query := map[string]interface{}{
+		"query": map[string]interface{}{
+			"filtered": map[string]interface{}{
+				"query":  map[string]interface{}{"match_all": map[string]interface{}{}},
+				"filter": map[string]interface{}{"bool": filter},
+			},
+		},
+		"sort": []interface{}{
+			map[string]interface{}{"Version": map[string]string{"order": "desc"}},
+		},
+		"size": 1,
+	}
+	res, err := ElasticSearch(TRANSFORM_TYPE, query)
+	if err != nil {
+		return
+	}
+	if len(res.Hits.Hits) == 0 {
+		err = NotFoundError{TRANSFORM_TYPE, name}
+		return
+	}
+	hit := res.Hits.Hits[0]
+	err = json.Unmarshal(hit.Source,&record)
+	id = hit.Id
+	return
+}
+
+// flags every transform version loaded from a template file as removed or restored
+func SetTransformTemplateRemoved(template string, removed bool) (ids []string, err error) {
+	query := map[string]interface{}{
+		"query": map[string]interface{}{
+			"term": map[string]interface{}{"Template": template},
+		},
+	}
+	ids = make([]string, 0)
+	records := make(map[string]TransformRecord)
+	err = ElasticScrollQuery(TRANSFORM_TYPE, query, func(hits []core.Hit) error {
+		for _, hit := range hits {
+			var record TransformRecord
+			if err := json.Unmarshal(hit.Source, &record); err != nil {
+				return err
+			}
+			records[hit.Id] = record
+		}
+		return nil
+	})
+	if err != nil {
+		return
+	}
+	for id, record := range records {
+		if record.Removed == removed {
+			continue
+		}
+		logger.LogDebug(LOGTAG,"Setting removed=%t on Transform %s version %d from file %s", removed, record.Name, record.Version, template)
+		record.Removed = removed
+		if err = ElasticUpdate(TRANSFORM_TYPE, id, record); err != nil {
+			return
+		}
+		ids = append(ids, id)
+	}
+	return
+}
+
+func GetTransformRecord(id string) (record TransformRecord, err error) {
+	err = ElasticGet(TRANSFORM_TYPE, id, &record)
+	return
+}
+
+func GetTransformByName(name string) (transform types.Transform, id string, err error) {
+	record, id, err := GetTransformRecordByName(name)
+	transform = record.Transform
+	return
+}
+
+func GetTransform(id string) (transform types.Transform, err error) {
+	err = ElasticGet(TRANSFORM_TYPE, id, &transform)
+	return
+}
+
+func GetState(id string) (state types.State, err error) {
+	err = ElasticGet(STATE_TYPE, id, &state)
 	return
 }
 
@@ -218,20 +816,6 @@ func UpdateInducedTransform(itransformId string, itransform types.InducedTransfo
 }
 
 func GetInducedTransform(id string) (itransform types.InducedTransform, err error) {
-	// search 
-	res, err := core.Get(true, PROTOML_INDEX, TRANSFORM_TYPE, id)
-	if err != nil {
-		return
-	}
-	if !res.Ok {
-		err = errors.New(fmt.Sprintf("elastic get failed on induced transform id %s",id))
-		return
-	}
-	if !res.Found {
-		err = errors.New(fmt.Sprintf("Can't find induced transform id %s",id))
-		return
-	}
-
-	itransform = res.Source.(types.InducedTransform)
+	err = ElasticGet(INDUCED_TRANSFORM_TYPE, id, &itransform)
 	return
 }
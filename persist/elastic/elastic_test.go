@@ -0,0 +1,126 @@
+package elastic
+
+import (
+	"encoding/json"
+	"github.com/ProtoML/ProtoML/types"
+	"testing"
+	"time"
+)
+
+func TestDecodeSource(t *testing.T) {
+	// elastigo returns get sources as generic json values
+	source := map[string]interface{}{
+		"Name":     "scale",
+		"Template": "scale.json",
+		"Version":  float64(3),
+	}
+	var record TransformRecord
+	if err := decodeSource(source, &record); err != nil {
+		t.Fatalf("decodeSource returned error: %s", err)
+	}
+	if record.Name != "scale" || record.Template != "scale.json" || record.Version != 3 {
+		t.Errorf("decodeSource(%v) = %+v", source, record)
+	}
+
+	var transform types.Transform
+	if err := decodeSource(source, &transform); err != nil {
+		t.Fatalf("decodeSource returned error: %s", err)
+	}
+	if transform.Name != "scale" {
+		t.Errorf("decodeSource(%v).Name = %s, want scale", source, transform.Name)
+	}
+}
+
+func TestIsNotFound(t *testing.T) {
+	if !IsNotFound(NotFoundError{DATAGROUP_TYPE, "abc"}) {
+		t.Errorf("IsNotFound(NotFoundError) = false, want true")
+	}
+	if IsNotFound(nil) {
+		t.Errorf("IsNotFound(nil) = true, want false")
+	}
+}
+
+func TestBuildSearchQueryMatchAll(t *testing.T) {
+	query := buildSearchQuery(DATAGROUP_TYPE, SearchQuery{Name: "ignored for datagroups"})
+	if _, ok := query["query"].(map[string]interface{})["match_all"]; !ok {
+		t.Errorf("buildSearchQuery with no applicable filters = %v, want match_all", query)
+	}
+}
+
+func TestBuildSearchQueryFilters(t *testing.T) {
+	query := buildSearchQuery(DATAGROUP_TYPE, SearchQuery{
+		Tags:   []string{"label", "target"},
+		Source: "data/train.csv",
+	})
+	filtered := query["query"].(map[string]interface{})["filtered"].(map[string]interface{})
+	filter := filtered["filter"].(map[string]interface{})["bool"].(map[string]interface{})
+	if must := filter["must"].([]interface{}); len(must) != 3 {
+		t.Errorf("buildSearchQuery must filters = %v, want 2 tags and a source", must)
+	}
+
+	query = buildSearchQuery(INDUCED_TRANSFORM_TYPE, SearchQuery{Status: STATUS_INVALID})
+	filtered = query["query"].(map[string]interface{})["filtered"].(map[string]interface{})
+	filter = filtered["filter"].(map[string]interface{})["bool"].(map[string]interface{})
+	must := filter["must"].([]interface{})
+	if len(must) != 1 || must[0].(map[string]interface{})["term"].(map[string]interface{})[STATUS_FIELD] != STATUS_INVALID {
+		t.Errorf("buildSearchQuery for invalid status = %v, want a status term filter", filter)
+	}
+
+	after := time.Date(2013, 10, 1, 0, 0, 0, 0, time.UTC)
+	query = buildSearchQuery(DATAGROUP_TYPE, SearchQuery{CreatedAfter: after})
+	filtered = query["query"].(map[string]interface{})["filtered"].(map[string]interface{})
+	filter = filtered["filter"].(map[string]interface{})["bool"].(map[string]interface{})
+	createdRange := filter["must"].([]interface{})[0].(map[string]interface{})["range"].(map[string]interface{})
+	if gte := createdRange[CREATED_FIELD].(map[string]interface{})["gte"]; gte != toMillis(after) {
+		t.Errorf("buildSearchQuery created range = %v, want gte %d", createdRange, toMillis(after))
+	}
+}
+
+func TestStampSource(t *testing.T) {
+	itransform := types.InducedTransform{Name: "scale", Error: "missing input"}
+	source, err := stampSource(INDUCED_TRANSFORM_TYPE, itransform, 42)
+	if err != nil {
+		t.Fatalf("stampSource returned error: %s", err)
+	}
+	var stamped struct {
+		Name    string
+		Created int64
+		Status  string
+	}
+	if err = json.Unmarshal(source, &stamped); err != nil {
+		t.Fatalf("stampSource returned bad json: %s", err)
+	}
+	if stamped.Name != "scale" || stamped.Created != 42 || stamped.Status != STATUS_INVALID {
+		t.Errorf("stampSource(%+v) = %s", itransform, source)
+	}
+
+	// existing creation times are kept
+	source, err = stampSource(DATAGROUP_TYPE, source, 7)
+	if err != nil {
+		t.Fatalf("stampSource returned error: %s", err)
+	}
+	if err = json.Unmarshal(source, &stamped); err != nil || stamped.Created != 42 {
+		t.Errorf("stampSource replaced creation time: %s", source)
+	}
+}
+
+func TestSanitizeNamespace(t *testing.T) {
+	cases := map[string]string{
+		"":              "",
+		"train_1":       "train_1",
+		"My-Experiment": "my_experiment",
+		"x_migrating":   "x_",
+	}
+	for namespace, want := range cases {
+		sanitized := SanitizeNamespace(namespace)
+		if sanitized != want {
+			t.Errorf("SanitizeNamespace(%q) = %q, want %q", namespace, sanitized, want)
+		}
+		if err := ValidateNamespace(sanitized); err != nil {
+			t.Errorf("SanitizeNamespace(%q) = %q is not valid: %s", namespace, sanitized, err)
+		}
+	}
+	if ValidateNamespace("x_migrating") == nil {
+		t.Errorf("ValidateNamespace accepted the migrating suffix")
+	}
+}
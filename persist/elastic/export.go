@@ -0,0 +1,147 @@
+package elastic
+
+import (
+	"encoding/json"
+	"github.com/ProtoML/ProtoML/logger"
+	"github.com/mattbaird/elastigo/core"
+	"time"
+)
+
+// a record of any type as exported from an index
+type ExportedRecord struct {
+	// empty for records exported before namespaces were recorded
+	Namespace string `json:",omitempty"`
+	Type      string
+	Id        string
+	Source    json.RawMessage
+}
+
+// notified of every record written to or deleted from elasticsearch, for keeping copies of the metadata
+type RecordObserver interface {
+	RecordWritten(record ExportedRecord) error
+	RecordDeleted(namespace string, elastictype string, elasticid string) error
+}
+
+var recordObserver RecordObserver
+
+// sets the observer of every record write, nil stops observing
+func ObserveRecords(observer RecordObserver) {
+	recordObserver = observer
+}
+
+// calls handle with every record in the current index, except the schema version
+func ExportRecords(handle func(record ExportedRecord) error) (err error) {
+	return exportIndexRecords(currentNamespace, handle)
+}
+
+// calls handle with every record in a namespace, whether or not it is in use
+func ExportNamespaceRecords(namespace string, handle func(record ExportedRecord) error) (err error) {
+	if err = ValidateNamespace(namespace); err != nil {
+		return
+	}
+	return exportIndexRecords(namespace, handle)
+}
+
+// calls handle with every record of every namespace
+func ExportAllRecords(handle func(record ExportedRecord) error) (err error) {
+	namespaces, err := ListNamespaces()
+	if err != nil {
+		return
+	}
+	for _, namespace := range namespaces {
+		if err = exportIndexRecords(namespace, handle); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func exportIndexRecords(namespace string, handle func(record ExportedRecord) error) (err error) {
+	for _, recordType := range RecordTypes() {
+		if recordType == META_TYPE {
+			continue
+		}
+		err = scrollIndex(NamespaceIndex(namespace), recordType, nil, func(hits []core.Hit) error {
+			for _, hit := range hits {
+				if err := handle(ExportedRecord{namespace, recordType, hit.Id, hit.Source}); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// indexes exported records into the current index keeping their ids
+func ImportRecords(records []ExportedRecord) (err error) {
+	return importIndexRecords(currentNamespace, records)
+}
+
+// indexes exported records into a namespace keeping their ids
+func ImportNamespaceRecords(namespace string, records []ExportedRecord) (err error) {
+	if err = ValidateNamespace(namespace); err != nil {
+		return
+	}
+	return importIndexRecords(namespace, records)
+}
+
+func importIndexRecords(namespace string, records []ExportedRecord) (err error) {
+	if len(records) == 0 {
+		return
+	}
+	// records exported before creation times were stored are stamped with the import time
+	created := toMillis(time.Now())
+	hits := make([]core.Hit, len(records))
+	for i, record := range records {
+		source, err := stampSource(record.Type, record.Source, created)
+		if err != nil {
+			return err
+		}
+		records[i].Namespace = namespace
+		records[i].Source = source
+		hits[i] = core.Hit{Type: record.Type, Id: record.Id, Source: source}
+	}
+	err = bulkIndexHits(NamespaceIndex(namespace), hits)
+	if err != nil || recordObserver == nil {
+		return
+	}
+	for _, record := range records {
+		if err = recordObserver.RecordWritten(record); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// deletes every record in the current index, leaving it empty with the current mappings
+func ResetIndex() (err error) {
+	return ResetNamespace(currentNamespace)
+}
+
+// deletes every record in a namespace, leaving it empty with the current mappings.
+// the namespace is created if it does not exist.
+func ResetNamespace(namespace string) (err error) {
+	if err = ValidateNamespace(namespace); err != nil {
+		return
+	}
+	index := NamespaceIndex(namespace)
+	logger.LogInfo(LOGTAG, "Resetting index %s", index)
+	indexes, err := listIndexes()
+	if err != nil {
+		return
+	}
+	if indexes[index] {
+		if err = deleteIndex(index); err != nil {
+			return
+		}
+	}
+	err = createMappedIndex(index)
+	if err != nil {
+		return
+	}
+	return setSchemaVersion(index, LatestSchemaVersion())
+}
@@ -0,0 +1,463 @@
+package elastic
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/ProtoML/ProtoML/logger"
+	"github.com/ProtoML/ProtoML/types"
+	"github.com/mattbaird/elastigo/api"
+	"github.com/mattbaird/elastigo/core"
+	"time"
+)
+
+const (
+	META_TYPE        = "meta"
+	SCHEMA_ID        = "schema"
+	MIGRATION_ID     = "migration"
+	MIGRATING_SUFFIX = "_migrating"
+	SCROLL_KEEPALIVE = "1m"
+	SCROLL_PAGE_SIZE = 500
+)
+
+// the schema version of an index, stored as a meta record
+type SchemaVersion struct {
+	Version int
+}
+
+// upgrades the index named by the argument to Version
+type Migration struct {
+	Version     int
+	Description string
+	Migrate     func(index string) error
+}
+
+// every schema change in order. Append a migration whenever Mappings or a record struct changes.
+var Migrations = []Migration{
+	{1, "Explicit mappings, creation times and induced transform status", remapAndStampIndex},
+	{2, "Datatypes keyed by name", keyDataTypesByName},
+}
+
+func LatestSchemaVersion() int {
+	return Migrations[len(Migrations)-1].Version
+}
+
+// exact match fields, never tokenized
+var keyword = map[string]interface{}{"type": "string", "index": "not_analyzed"}
+
+func properties(fields map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{"properties": fields}
+}
+
+// a top level record mapping, with the creation time every record stores in milliseconds
+func recordMapping(fields map[string]interface{}) map[string]interface{} {
+	fields[CREATED_FIELD] = map[string]interface{}{"type": "long"}
+	return properties(fields)
+}
+
+// explicit mappings for every record type, names and ids are matched exactly
+func Mappings() map[string]interface{} {
+	return map[string]interface{}{
+		DATATYPE_TYPE: recordMapping(map[string]interface{}{
+			"TypeName":    keyword,
+			"ParentTypes": keyword,
+		}),
+		DATAGROUP_TYPE: recordMapping(map[string]interface{}{
+			"Columns":    properties(map[string]interface{}{"ExclusiveType": keyword}),
+			"FileFormat": keyword,
+			"Source":     keyword,
+			"Tags":       keyword,
+			"ColumnTags": keyword,
+		}),
+		DATAFILE_TYPE: recordMapping(map[string]interface{}{
+			"Path":       keyword,
+			"FileFormat": keyword,
+			"DataIds":    keyword,
+		}),
+		DATAPARTS_TYPE: recordMapping(map[string]interface{}{
+			"ParentGroupId": keyword,
+			"ColPaths":      keyword,
+			"ColumnTags":    keyword,
+		}),
+		TRANSFORM_TYPE: recordMapping(map[string]interface{}{
+			"Name":        keyword,
+			"Template":    keyword,
+			"ContentHash": keyword,
+			"Version":     map[string]interface{}{"type": "integer"},
+			"Removed":     map[string]interface{}{"type": "boolean"},
+		}),
+		INDUCED_TRANSFORM_TYPE: recordMapping(map[string]interface{}{
+			"Name":       keyword,
+			"Template":   keyword,
+			"TemplateID": keyword,
+			"Function":   keyword,
+			"Error":      keyword,
+			"Status":     keyword,
+		}),
+		STATE_TYPE: recordMapping(map[string]interface{}{
+			"Source": keyword,
+		}),
+		META_TYPE: recordMapping(map[string]interface{}{}),
+	}
+}
+
+// every record type stored in an index
+func RecordTypes() (recordTypes []string) {
+	recordTypes = make([]string, 0)
+	for recordType := range Mappings() {
+		recordTypes = append(recordTypes, recordType)
+	}
+	return
+}
+
+// creates an index with the current mappings
+func createMappedIndex(index string) (err error) {
+	_, err = api.DoCommand("PUT", "/"+index, map[string]interface{}{"mappings": Mappings()})
+	return
+}
+
+func deleteIndex(index string) (err error) {
+	_, err = api.DoCommand("DELETE", "/"+index, nil)
+	return
+}
+
+func GetSchemaVersion(index string) (version int, err error) {
+	res, err := core.Get(true, index, META_TYPE, SCHEMA_ID)
+	if err != nil {
+		return
+	}
+	// indexes from before migrations have no schema record
+	if !res.Found && !res.Exists {
+		return 0, nil
+	}
+	var schema SchemaVersion
+	err = decodeSource(res.Source, &schema)
+	return schema.Version, err
+}
+
+func setSchemaVersion(index string, version int) (err error) {
+	_, err = core.IndexWithParameters(true, index, META_TYPE, SCHEMA_ID, "", 0, "index", "", "", 0, "", "", true, SchemaVersion{version})
+	return
+}
+
+// runs every migration newer than the schema version of index
+func MigrateIndex(index string) (err error) {
+	version, err := GetSchemaVersion(index)
+	if err != nil {
+		return
+	}
+	for _, migration := range Migrations {
+		if migration.Version <= version {
+			continue
+		}
+		logger.LogInfo(LOGTAG, "Migrating index %s to schema version %d: %s", index, migration.Version, migration.Description)
+		err = migration.Migrate(index)
+		if err != nil {
+			err = errors.New(fmt.Sprintf("Migration of index %s to schema version %d failed: %s", index, migration.Version, err))
+			return
+		}
+		err = setSchemaVersion(index, migration.Version)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// calls handle with every record of a type in index matching query, page by page.
+// a nil query matches every record.
+func scrollIndex(index, elastictype string, query map[string]interface{}, handle func(hits []core.Hit) error) (err error) {
+	pageQuery := map[string]interface{}{"size": SCROLL_PAGE_SIZE}
+	for key, value := range query {
+		pageQuery[key] = value
+	}
+	res, err := core.SearchRequest(true, index, elastictype, pageQuery, SCROLL_KEEPALIVE, 0)
+	if err != nil {
+		return
+	}
+	for len(res.Hits.Hits) > 0 {
+		err = ElasticSearchError(res, elastictype)
+		if err != nil {
+			return
+		}
+		err = handle(res.Hits.Hits)
+		if err != nil {
+			return
+		}
+		res, err = core.Scroll(true, res.ScrollId, SCROLL_KEEPALIVE)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// indexes hits into index keeping their types and ids, failing if any hit was rejected
+func bulkIndexHits(index string, hits []core.Hit) (err error) {
+	if len(hits) == 0 {
+		return
+	}
+	var body bytes.Buffer
+	for _, hit := range hits {
+		action, err := json.Marshal(map[string]interface{}{
+			"index": map[string]string{"_index": index, "_type": hit.Type, "_id": hit.Id},
+		})
+		if err != nil {
+			return err
+		}
+		body.Write(action)
+		body.WriteByte('\n')
+		body.Write(hit.Source)
+		body.WriteByte('\n')
+	}
+	_, err = bulkRequest(body.String(), len(hits), fmt.Sprintf("indexing into %s", index))
+	return
+}
+
+// copies every record, except the migration marker, from one index into another.
+// a non nil convert rewrites every record on the way.
+func copyIndex(fromIndex, toIndex string, convert func(hit core.Hit) (core.Hit, error)) (err error) {
+	for _, recordType := range RecordTypes() {
+		err = scrollIndex(fromIndex, recordType, nil, func(hits []core.Hit) error {
+			copied := make([]core.Hit, 0, len(hits))
+			for _, hit := range hits {
+				if hit.Type == META_TYPE && hit.Id == MIGRATION_ID {
+					continue
+				}
+				if convert != nil {
+					converted, err := convert(hit)
+					if err != nil {
+						return err
+					}
+					hit = converted
+				}
+				copied = append(copied, hit)
+			}
+			return bulkIndexHits(toIndex, copied)
+		})
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// rekeys the datatypes of index by their names, dropping the duplicates that startups registered
+// under random ids. The first record of a name is kept when duplicates disagree.
+func keyDataTypesByName(index string) (err error) {
+	kept := make(map[types.DataTypeName]types.DataType)
+	// observed copies of the rekeyed records are moved along with them
+	written := make([]ExportedRecord, 0)
+	deleted := make([]string, 0)
+	var body bytes.Buffer
+	actions := 0
+	addAction := func(action map[string]interface{}, source json.RawMessage) error {
+		line, err := json.Marshal(action)
+		if err != nil {
+			return err
+		}
+		body.Write(line)
+		body.WriteByte('\n')
+		if source != nil {
+			body.Write(source)
+			body.WriteByte('\n')
+		}
+		actions++
+		return nil
+	}
+	err = scrollIndex(index, DATATYPE_TYPE, nil, func(hits []core.Hit) error {
+		for _, hit := range hits {
+			var datatype types.DataType
+			if err := json.Unmarshal(hit.Source, &datatype); err != nil {
+				return err
+			}
+			if hit.Id != string(datatype.TypeName) {
+				err := addAction(map[string]interface{}{
+					"delete": map[string]string{"_index": index, "_type": DATATYPE_TYPE, "_id": hit.Id},
+				}, nil)
+				if err != nil {
+					return err
+				}
+				deleted = append(deleted, hit.Id)
+			}
+			if first, ok := kept[datatype.TypeName]; ok {
+				if !sameParentTypes(first, datatype) {
+					logger.LogInfo(LOGTAG, "Dropping datatype %s with parents %v, keeping parents %v", datatype.TypeName, datatype.ParentTypes, first.ParentTypes)
+				}
+				continue
+			}
+			kept[datatype.TypeName] = datatype
+			if hit.Id != string(datatype.TypeName) {
+				err := addAction(map[string]interface{}{
+					"index": map[string]string{"_index": index, "_type": DATATYPE_TYPE, "_id": string(datatype.TypeName)},
+				}, hit.Source)
+				if err != nil {
+					return err
+				}
+				written = append(written, ExportedRecord{IndexNamespace(index), DATATYPE_TYPE, string(datatype.TypeName), hit.Source})
+			}
+		}
+		return nil
+	})
+	if err != nil || actions == 0 {
+		return
+	}
+	_, err = bulkRequest(body.String(), actions, fmt.Sprintf("rekeying datatypes of %s", index))
+	if err != nil || recordObserver == nil {
+		return
+	}
+	for _, id := range deleted {
+		if err = recordObserver.RecordDeleted(IndexNamespace(index), DATATYPE_TYPE, id); err != nil {
+			return
+		}
+	}
+	for _, record := range written {
+		if err = recordObserver.RecordWritten(record); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// remaps index, storing the creation time and induced transform status every record needs.
+// indexes from before creation times were stored get the time of the migration.
+func remapAndStampIndex(index string) (err error) {
+	migrated := toMillis(time.Now())
+	return remapIndex(index, func(hit core.Hit) (core.Hit, error) {
+		if hit.Type == META_TYPE {
+			return hit, nil
+		}
+		source, err := stampSource(hit.Type, hit.Source, migrated)
+		hit.Source = source
+		return hit, err
+	})
+}
+
+// every index in the cluster
+func listIndexes() (indexes map[string]bool, err error) {
+	body, err := api.DoCommand("GET", "/_aliases", nil)
+	if err != nil {
+		return
+	}
+	aliases := make(map[string]interface{})
+	err = json.Unmarshal(body, &aliases)
+	if err != nil {
+		return
+	}
+	indexes = make(map[string]bool)
+	for index := range aliases {
+		indexes[index] = true
+	}
+	return
+}
+
+func countIndex(index string) (count int, err error) {
+	body, err := api.DoCommand("GET", "/"+index+"/_count", nil)
+	if err != nil {
+		return
+	}
+	var result struct {
+		Count int `json:"count"`
+	}
+	err = json.Unmarshal(body, &result)
+	return result.Count, err
+}
+
+// whether the temporary index of a migration holds every record of the original
+func isMigrationComplete(migrating string) bool {
+	res, err := core.Get(true, migrating, META_TYPE, MIGRATION_ID)
+	if err != nil {
+		return false
+	}
+	return res.Found || res.Exists
+}
+
+// finishes or discards the temporary index left by an interrupted migration of index.
+// once the temporary index is marked complete it replaces the original, otherwise the original is
+// intact and the temporary index is deleted.
+func RecoverMigration(index string) (err error) {
+	migrating := index + MIGRATING_SUFFIX
+	indexes, err := listIndexes()
+	if err != nil || !indexes[migrating] {
+		return
+	}
+	if !isMigrationComplete(migrating) {
+		if !indexes[index] {
+			return errors.New(fmt.Sprintf("Index %s is missing and %s left by an interrupted migration is incomplete", index, migrating))
+		}
+		logger.LogInfo(LOGTAG, "Deleting incomplete index %s left by an interrupted migration, %s is intact", migrating, index)
+		return deleteIndex(migrating)
+	}
+	logger.LogInfo(LOGTAG, "Restoring index %s from %s left by an interrupted migration", index, migrating)
+	if indexes[index] {
+		if err = deleteIndex(index); err != nil {
+			return
+		}
+	}
+	return finishRemap(index, migrating)
+}
+
+// recreates index with the current mappings, copying every record through a temporary index.
+// the original index is only deleted once every record was copied.
+func RemapIndex(index string) (err error) {
+	return remapIndex(index, nil)
+}
+
+// remaps index, converting every record as it is copied into the temporary index
+func remapIndex(index string, convert func(hit core.Hit) (core.Hit, error)) (err error) {
+	if err = RecoverMigration(index); err != nil {
+		return
+	}
+	migrating := index + MIGRATING_SUFFIX
+	err = createMappedIndex(migrating)
+	if err != nil {
+		return
+	}
+	err = copyIndex(index, migrating, convert)
+	if err == nil {
+		err = verifyCopy(index, migrating)
+	}
+	if err != nil {
+		deleteIndex(migrating)
+		return errors.New(fmt.Sprintf("%s, index %s is unchanged", err, index))
+	}
+	// from here on the temporary index replaces the original if the migration is interrupted
+	_, err = core.IndexWithParameters(true, migrating, META_TYPE, MIGRATION_ID, "", 0, "index", "", "", 0, "", "", true, map[string]bool{"Complete": true})
+	if err != nil {
+		deleteIndex(migrating)
+		return
+	}
+	err = deleteIndex(index)
+	if err != nil {
+		return
+	}
+	return finishRemap(index, migrating)
+}
+
+func verifyCopy(fromIndex, toIndex string) (err error) {
+	fromCount, err := countIndex(fromIndex)
+	if err != nil {
+		return
+	}
+	toCount, err := countIndex(toIndex)
+	if err != nil {
+		return
+	}
+	if fromCount != toCount {
+		err = errors.New(fmt.Sprintf("copied %d of %d records from %s", toCount, fromCount, fromIndex))
+	}
+	return
+}
+
+// recreates index from the complete temporary index of a migration
+func finishRemap(index, migrating string) (err error) {
+	err = createMappedIndex(index)
+	if err == nil {
+		err = copyIndex(migrating, index, nil)
+	}
+	if err != nil {
+		return errors.New(fmt.Sprintf("%s, records are kept in index %s", err, migrating))
+	}
+	return deleteIndex(migrating)
+}
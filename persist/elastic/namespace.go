@@ -0,0 +1,130 @@
+package elastic
+
+import (
+	"errors"
+	"fmt"
+	"github.com/ProtoML/ProtoML/logger"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const NAMESPACE_SEPARATOR = "-"
+
+var (
+	// the namespace and index every record is read from and written to
+	currentNamespace      = ""
+	currentIndex          = PROTOML_INDEX
+	validNamespace        = regexp.MustCompile("^[a-z0-9_]+$")
+	invalidNamespaceChars = regexp.MustCompile("[^a-z0-9_]")
+)
+
+// the index holding the records of a namespace, the empty namespace uses the base index
+func NamespaceIndex(namespace string) string {
+	if len(namespace) == 0 {
+		return PROTOML_INDEX
+	}
+	return PROTOML_INDEX + NAMESPACE_SEPARATOR + namespace
+}
+
+// the namespace whose records an index holds, the inverse of NamespaceIndex
+func IndexNamespace(index string) string {
+	return strings.TrimPrefix(strings.TrimPrefix(index, PROTOML_INDEX), NAMESPACE_SEPARATOR)
+}
+
+func ValidateNamespace(namespace string) (err error) {
+	if len(namespace) > 0 && !validNamespace.MatchString(namespace) {
+		err = errors.New(fmt.Sprintf("Namespace %s may only contain lowercase letters, digits and underscores", namespace))
+	} else if strings.HasSuffix(namespace, MIGRATING_SUFFIX) {
+		err = errors.New(fmt.Sprintf("Namespace %s may not end in %s", namespace, MIGRATING_SUFFIX))
+	}
+	return
+}
+
+// maps a configured namespace to a valid one, lowercasing it and replacing other characters with
+// underscores, so configs written before namespaces were validated keep working
+func SanitizeNamespace(namespace string) string {
+	sanitized := invalidNamespaceChars.ReplaceAllString(strings.ToLower(namespace), "_")
+	for strings.HasSuffix(sanitized, MIGRATING_SUFFIX) {
+		sanitized = strings.TrimSuffix(sanitized, MIGRATING_SUFFIX) + "_"
+	}
+	return sanitized
+}
+
+// scopes every elastic function to a namespace
+func UseNamespace(namespace string) (err error) {
+	if err = ValidateNamespace(namespace); err != nil {
+		return
+	}
+	logger.LogDebug(LOGTAG, "Using namespace %q in index %s", namespace, NamespaceIndex(namespace))
+	currentNamespace = namespace
+	currentIndex = NamespaceIndex(namespace)
+	return
+}
+
+func CurrentIndex() string {
+	return currentIndex
+}
+
+func CurrentNamespace() string {
+	return currentNamespace
+}
+
+func ListNamespaces() (namespaces []string, err error) {
+	indices, err := listIndexes()
+	if err != nil {
+		return
+	}
+	namespaces = make([]string, 0)
+	for index := range indices {
+		// temporary indexes left by migrations are not namespaces
+		if strings.HasSuffix(index, MIGRATING_SUFFIX) {
+			continue
+		}
+		if index == PROTOML_INDEX {
+			namespaces = append(namespaces, "")
+		} else if strings.HasPrefix(index, PROTOML_INDEX+NAMESPACE_SEPARATOR) {
+			namespaces = append(namespaces, strings.TrimPrefix(index, PROTOML_INDEX+NAMESPACE_SEPARATOR))
+		}
+	}
+	sort.Strings(namespaces)
+	return
+}
+
+func NamespaceExists(namespace string) (exists bool, err error) {
+	namespaces, err := ListNamespaces()
+	if err != nil {
+		return
+	}
+	for _, existing := range namespaces {
+		if existing == namespace {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func CreateNamespace(namespace string) (err error) {
+	if err = ValidateNamespace(namespace); err != nil {
+		return
+	}
+	logger.LogDebug(LOGTAG, "Creating namespace %q", namespace)
+	err = createMappedIndex(NamespaceIndex(namespace))
+	if err != nil {
+		return
+	}
+	return setSchemaVersion(NamespaceIndex(namespace), LatestSchemaVersion())
+}
+
+// deletes a namespace and every record in it, the namespace in use cannot be dropped
+func DropNamespace(namespace string) (err error) {
+	if err = ValidateNamespace(namespace); err != nil {
+		return
+	}
+	if NamespaceIndex(namespace) == currentIndex {
+		err = errors.New(fmt.Sprintf("Cannot drop namespace %q while it is in use", namespace))
+		return
+	}
+	logger.LogDebug(LOGTAG, "Dropping namespace %q", namespace)
+	return deleteIndex(NamespaceIndex(namespace))
+}
@@ -0,0 +1,201 @@
+package elastic
+
+import (
+	"encoding/json"
+	"github.com/ProtoML/ProtoML/types"
+	"github.com/mattbaird/elastigo/core"
+	"time"
+)
+
+const (
+	STATUS_VALID   = "valid"
+	STATUS_INVALID = "invalid"
+)
+
+// filters for searching records, empty fields match everything.
+// fields that do not apply to a record type are ignored.
+type SearchQuery struct {
+	// transform and induced transform name
+	Name string
+	// datagroups having every tag
+	Tags []string
+	// datagroup column type
+	ExclusiveType types.DataTypeName
+	// datagroup source, a dataset file path or the induced transform that produced it
+	Source string
+	// transform template file, or induced transform template id
+	Template string
+	// induced transforms that are STATUS_VALID or STATUS_INVALID against their template
+	Status string
+	// creation time range
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+}
+
+type DataGroupResult struct {
+	Id         string
+	DataGroup  types.DataGroup
+	Tags       []string
+	ColumnTags [][]string
+}
+
+// a single column of a datagroup, usable as an induced transform input
+type ColumnReference struct {
+	DataId        types.ElasticID
+	Column        int
+	ExclusiveType types.DataTypeName
+	Tags          []string
+}
+
+type TransformResult struct {
+	Id        string
+	Transform types.Transform
+	Version   int
+	Removed   bool
+}
+
+type InducedTransformResult struct {
+	Id               string
+	InducedTransform types.InducedTransform
+}
+
+func termFilter(field string, value interface{}) map[string]interface{} {
+	return map[string]interface{}{"term": map[string]interface{}{field: value}}
+}
+
+// builds an elasticsearch query from the filters that apply to elastictype
+func buildSearchQuery(elastictype string, query SearchQuery) map[string]interface{} {
+	must := make([]interface{}, 0)
+
+	if len(query.Name) > 0 && (elastictype == TRANSFORM_TYPE || elastictype == INDUCED_TRANSFORM_TYPE) {
+		must = append(must, termFilter("Name", query.Name))
+	}
+	if elastictype == DATAGROUP_TYPE {
+		for _, tag := range query.Tags {
+			must = append(must, termFilter("Tags", tag))
+		}
+		if len(query.ExclusiveType) > 0 {
+			must = append(must, termFilter("Columns.ExclusiveType", query.ExclusiveType))
+		}
+		if len(query.Source) > 0 {
+			must = append(must, termFilter("Source", query.Source))
+		}
+	}
+	if len(query.Template) > 0 {
+		if elastictype == TRANSFORM_TYPE {
+			must = append(must, termFilter("Template", query.Template))
+		} else if elastictype == INDUCED_TRANSFORM_TYPE {
+			must = append(must, termFilter("TemplateID", query.Template))
+		}
+	}
+	if elastictype == INDUCED_TRANSFORM_TYPE {
+		// the status is derived from the validation error when the induced transform is written
+		if query.Status == STATUS_VALID || query.Status == STATUS_INVALID {
+			must = append(must, termFilter(STATUS_FIELD, query.Status))
+		}
+	}
+	if !query.CreatedAfter.IsZero() || !query.CreatedBefore.IsZero() {
+		timeRange := make(map[string]interface{})
+		if !query.CreatedAfter.IsZero() {
+			timeRange["gte"] = toMillis(query.CreatedAfter)
+		}
+		if !query.CreatedBefore.IsZero() {
+			timeRange["lte"] = toMillis(query.CreatedBefore)
+		}
+		must = append(must, map[string]interface{}{"range": map[string]interface{}{CREATED_FIELD: timeRange}})
+	}
+
+	if len(must) == 0 {
+		return map[string]interface{}{"query": map[string]interface{}{"match_all": map[string]interface{}{}}}
+	}
+	filter := map[string]interface{}{"must": must}
+	return map[string]interface{}{
+		"query": map[string]interface{}{
+			"filtered": map[string]interface{}{
+				"query":  map[string]interface{}{"match_all": map[string]interface{}{}},
+				"filter": map[string]interface{}{"bool": filter},
+			},
+		},
+	}
+}
+
+// calls handle with the id and source of every record of elastictype matching query
+func searchEach(elastictype string, query SearchQuery, handle func(id string, source json.RawMessage) error) (err error) {
+	return ElasticScrollQuery(elastictype, buildSearchQuery(elastictype, query), func(hits []core.Hit) error {
+		for _, hit := range hits {
+			if err := handle(hit.Id, hit.Source); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func SearchDataGroups(query SearchQuery) (results []DataGroupResult, err error) {
+	results = make([]DataGroupResult, 0)
+	err = searchEach(DATAGROUP_TYPE, query, func(id string, source json.RawMessage) error {
+		var record DataGroupRecord
+		if err := json.Unmarshal(source, &record); err != nil {
+			return err
+		}
+		results = append(results, DataGroupResult{id, record.DataGroup, record.Tags, record.ColumnTags})
+		return nil
+	})
+	return
+}
+
+func SearchTransforms(query SearchQuery) (results []TransformResult, err error) {
+	results = make([]TransformResult, 0)
+	err = searchEach(TRANSFORM_TYPE, query, func(id string, source json.RawMessage) error {
+		var record TransformRecord
+		if err := json.Unmarshal(source, &record); err != nil {
+			return err
+		}
+		results = append(results, TransformResult{id, record.Transform, record.Version, record.Removed})
+		return nil
+	})
+	return
+}
+
+func SearchInducedTransforms(query SearchQuery) (results []InducedTransformResult, err error) {
+	results = make([]InducedTransformResult, 0)
+	err = searchEach(INDUCED_TRANSFORM_TYPE, query, func(id string, source json.RawMessage) error {
+		var itransform types.InducedTransform
+		if err := json.Unmarshal(source, &itransform); err != nil {
+			return err
+		}
+		results = append(results, InducedTransformResult{id, itransform})
+		return nil
+	})
+	return
+}
+
+// selects the columns tagged tag across every datagroup matching query
+func SelectColumnsByTag(tag string, query SearchQuery) (columns []ColumnReference, err error) {
+	query.Tags = append(append([]string{}, query.Tags...), tag)
+	datagroups, err := SearchDataGroups(query)
+	if err != nil {
+		return
+	}
+	columns = make([]ColumnReference, 0)
+	for _, datagroup := range datagroups {
+		for col, colTags := range datagroup.ColumnTags {
+			for _, colTag := range colTags {
+				if colTag == tag {
+					columns = append(columns, ColumnReference{types.ElasticID(datagroup.Id), col, datagroup.DataGroup.Columns.ExclusiveType, colTags})
+					break
+				}
+			}
+		}
+	}
+	return
+}
+
+// groups column references by their datagroup, keeping column order
+func ColumnsByDataGroup(columns []ColumnReference) (groups map[types.ElasticID][]int) {
+	groups = make(map[types.ElasticID][]int)
+	for _, column := range columns {
+		groups[column.DataId] = append(groups[column.DataId], column.Column)
+	}
+	return
+}
@@ -1,18 +1,25 @@
 package persist
 
 import (
+	"fmt"
+	"sort"
 	"github.com/ProtoML/ProtoML/types"
 	"github.com/ProtoML/ProtoML/formatadaptor"
 	"github.com/ProtoML/ProtoML-persist/persist/elastic"
 	"strings"
 	"github.com/ProtoML/ProtoML/utils/osutils"
 	"path"
+	"path/filepath"
 )
 
 type LocalPersistStorageConfig struct {
 	RootDir string
 	StateDir string
 	ElasticPort  int
+	// host or host:port of a running elasticsearch to use instead of spawning one
+	ElasticHost string
+	// seconds to wait for elasticsearch and luigid to become ready
+	StartupTimeout int
 	DatasetDirectory string
 	InputFiles []types.DatasetFile
 }
@@ -20,10 +27,164 @@ type LocalPersistStorageConfig struct {
 type Config struct {
 	TrainNamespace string
 	ExternalTransformDirectories string
+	DataTypeDirectory string
 	LocalPersistStorage LocalPersistStorageConfig
 	FormatCollection *formatadaptor.FileFormatCollection
 }
   
+// an induced transform whose template has a newer version
+type OutdatedInducedTransform struct {
+	InducedTransformID string
+	TemplateID string
+	TemplateVersion int
+	LatestTemplateID string
+	LatestTemplateVersion int
+}
+
+// progress of a dataset file ingestion
+type IngestProgress struct {
+	Path string
+	BytesRead int64
+	TotalBytes int64
+	Rows int
+	Done bool
+}
+
+type IngestOptions struct {
+	// bytes of column output buffered in memory while splitting, 0 uses the storage default
+	MemoryBudget int
+	// called after every chunk of rows and, with Done set, once the ingestion ends whether it
+	// succeeded or not. May be nil
+	Progress func(progress IngestProgress)
+}
+
+// a progress callback sending to a channel. Updates are dropped while the receiver is behind,
+// except the final one, which is delivered in the background when the receiver is behind so
+// ingestion never waits for it. It can be received after ingestion returned.
+func ProgressChannel(progress chan<- IngestProgress) func(IngestProgress) {
+	return func(update IngestProgress) {
+		select {
+		case progress <- update:
+		default:
+			if update.Done {
+				go func() {
+					progress <- update
+				}()
+			}
+		}
+	}
+}
+
+// an induced transform in the upstream chain of a datagroup
+type LineageStep struct {
+	InducedTransformID string
+	InducedTransform types.InducedTransform
+	// the transform version the induced transform was made from, zero when it is not known
+	Transform types.Transform
+	// the datagroups and states the induced transform reads
+	InputDataIDs []string
+	InputStateIDs []string
+}
+
+// everything upstream of a datagroup
+type Lineage struct {
+	DataID string
+	// producing induced transforms, nearest first
+	Steps []LineageStep
+	// the dataset files the chain starts from, only Path is known for files ingested before
+	// dataset files were recorded
+	DatasetFiles []types.DatasetFile
+}
+
+// everything downstream of a datagroup
+type Descendants struct {
+	DataID string
+	InducedTransformIDs []string
+	DataIDs []string
+	StateIDs []string
+}
+
+const MAX_REPORTED_VALUES = 100
+
+// a value that its column's datatype does not recognize
+type BadDatasetValue struct {
+	Row int
+	Column int
+	DataType types.DataTypeName
+	Value string
+}
+
+// the differences between a dataset file and its declared shape and column datatypes.
+// rows and columns are indexed from 0. Returned as the error of a failed ingestion.
+type DatasetReport struct {
+	Path string
+	DeclaredRows int
+	DeclaredCols int
+	Rows int
+	// the first MAX_REPORTED_VALUES rows whose number of columns is not DeclaredCols,
+	// by row, and how many there are in all
+	BadShapeRows map[int]int
+	BadShapeRowCount int
+	// the first MAX_REPORTED_VALUES unrecognized values, and how many there are in all
+	BadValues []BadDatasetValue
+	BadValueCount int
+}
+
+func NewDatasetReport(dataFile types.DatasetFile) *DatasetReport {
+	return &DatasetReport{
+		Path: dataFile.Path,
+		DeclaredRows: dataFile.NRows,
+		DeclaredCols: dataFile.NCols,
+		BadShapeRows: make(map[int]int),
+		BadValues: make([]BadDatasetValue, 0),
+	}
+}
+
+func (report *DatasetReport) AddBadShapeRow(row int, cols int) {
+	if len(report.BadShapeRows) < MAX_REPORTED_VALUES {
+		report.BadShapeRows[row] = cols
+	}
+	report.BadShapeRowCount++
+}
+
+func (report *DatasetReport) AddBadValue(value BadDatasetValue) {
+	if len(report.BadValues) < MAX_REPORTED_VALUES {
+		report.BadValues = append(report.BadValues, value)
+	}
+	report.BadValueCount++
+}
+
+func (report *DatasetReport) OK() bool {
+	return report.Rows == report.DeclaredRows && report.BadShapeRowCount == 0 && report.BadValueCount == 0
+}
+
+func (report *DatasetReport) Error() string {
+	problems := make([]string, 0)
+	if report.Rows != report.DeclaredRows {
+		problems = append(problems, fmt.Sprintf("has %d rows instead of %d", report.Rows, report.DeclaredRows))
+	}
+	if report.BadShapeRowCount > 0 {
+		rows := make([]int, 0, len(report.BadShapeRows))
+		for row := range report.BadShapeRows {
+			rows = append(rows, row)
+		}
+		sort.Ints(rows)
+		shapes := make([]string, len(rows))
+		for i, row := range rows {
+			shapes[i] = fmt.Sprintf("row %d has %d", row, report.BadShapeRows[row])
+		}
+		problems = append(problems, fmt.Sprintf("%d rows do not have %d columns (%s)", report.BadShapeRowCount, report.DeclaredCols, strings.Join(shapes, ", ")))
+	}
+	if report.BadValueCount > 0 {
+		values := make([]string, len(report.BadValues))
+		for i, value := range report.BadValues {
+			values[i] = fmt.Sprintf("row %d column %d %q is not %s", value.Row, value.Column, value.Value, value.DataType)
+		}
+		problems = append(problems, fmt.Sprintf("%d values do not parse as their column datatype (%s)", report.BadValueCount, strings.Join(values, ", ")))
+	}
+	return fmt.Sprintf("Dataset file %s %s", report.Path, strings.Join(problems, "; "))
+}
+
 type PersistStorage interface {
 	// Initialize file structure / databases
 	Init(config Config) error
@@ -34,13 +195,33 @@ type PersistStorage interface {
 	//IsDone(transformId string) (bool, error)
 	// runs the induced transform
 	Run(itransformId string) error
+	// runs the induced transform, first running its upstream induced transforms that have not completed when upstream is set
+	RunWithUpstream(itransformId string, upstream bool) error
+	// get the upstream induced transforms of an induced transform, dependencies first
+	ResolveDependencies(itransformId string) (order []string, err error)
 	// execute entire pipeline
 	Execute() error
 	// get log file for transform
 	//GetTransformLogFile(transformId string) (string, error)
 
+	// list, create and drop the namespaces separating experiments
+	ListNamespaces() (namespaces []string, err error)
+	CreateNamespace(namespace string) (err error)
+	DropNamespace(namespace string) (err error)
+
+	// search records by their metadata
+	SearchDataGroups(query elastic.SearchQuery) (results []elastic.DataGroupResult, err error)
+	SearchTransforms(query elastic.SearchQuery) (results []elastic.TransformResult, err error)
+	SearchInducedTransforms(query elastic.SearchQuery) (results []elastic.InducedTransformResult, err error)
+	// select the columns with a tag across the datagroups matching query
+	SelectColumnsByTag(tag string, query elastic.SearchQuery) (columns []elastic.ColumnReference, err error)
+
 	// get graph id vertices and id edges
 	GetGraph() (types.ProtoMLGraph, error)
+	// get the induced transforms and dataset files a datagroup was produced from
+	GetLineage(dataId string) (lineage Lineage, err error)
+	// get the induced transforms, datagroups and states produced from a datagroup
+	GetDescendants(dataId string) (descendants Descendants, err error)
 
 	// add induced transform
 	AddInducedTransform(itransform types.InducedTransform) (itransformID string, err error)
@@ -48,11 +229,23 @@ type PersistStorage interface {
 	UpdateInducedTransform(itransformId string, itransform types.InducedTransform) (err error)
 	// delete induced transform
 	//DeleteInducedTransform(itransformId string) (err error)
+	// list induced transforms pinned to an outdated transform version
+	GetOutdatedInducedTransforms() (outdated []OutdatedInducedTransform, err error)
+	// repin induced transform to the latest version of its transform
+	UpgradeInducedTransform(itransformId string) (templateID string, err error)
 
+	// insert datatypes from a definition file
+	AddDataTypeFile(datatypeFile string) (datatypes []types.DataType, err error)
 	// insert data on a tranform from a file
 	AddTransformFile(transformFile string) (transform types.Transform, transformID string, err error)
+	// get the latest version of a transform by name
+	GetTransformByName(name string) (transform types.Transform, transformID string, err error)
+	// scan a dataset file to guess its shape and column datatypes, for review before AddDataFile
+	InferDatasetFile(datasetPath, format string) (dataFile types.DatasetFile, err error)
 	// insert data file into persist
 	AddDataFile(dataFile types.DatasetFile) (dataID []string, err error)
+	// insert data file into persist within a memory budget, reporting progress
+	AddDataFileWithOptions(dataFile types.DatasetFile, options IngestOptions) (dataID []string, err error)
 }
 
 func AddDataTypes(datatypes []types.DataType) (err error) {
@@ -65,16 +258,43 @@ func AddDataTypes(datatypes []types.DataType) (err error) {
 	return nil
 }
 
-func GetTransformFiles(transformDir string) (transformFiles []string, err error) {
-	dirFiles, err := osutils.ListFilesInDirectory(transformDir)
+func GetJSONFiles(dir string) (jsonFiles []string, err error) {
+	dirFiles, err := osutils.ListFilesInDirectory(dir)
 	if err != nil {
 		return
 	}
-	transformFiles = make([]string, 0)
+	jsonFiles = make([]string, 0)
 	for _, file := range dirFiles {
 		if strings.HasSuffix(file,".json") {
-			transformFiles = append(transformFiles,path.Join(transformDir,file))
+			jsonFiles = append(jsonFiles,path.Join(dir,file))
 		}
 	}
 	return 
 }
+
+func GetTransformFiles(transformDir string) (transformFiles []string, err error) {
+	return GetJSONFiles(transformDir)
+}
+
+// lists the transform files of every directory in a path list such as Config.ExternalTransformDirectories.
+// directories that cannot be listed are reported in dirErrs and skipped.
+func GetExternalTransformFiles(externalTransformDirectories string) (transformFiles []string, dirErrs map[string]error) {
+	transformFiles = make([]string, 0)
+	dirErrs = make(map[string]error)
+	for _, transformDir := range filepath.SplitList(externalTransformDirectories) {
+		if len(transformDir) == 0 {
+			continue
+		}
+		dirFiles, err := GetTransformFiles(transformDir)
+		if err != nil {
+			dirErrs[transformDir] = err
+			continue
+		}
+		transformFiles = append(transformFiles, dirFiles...)
+	}
+	return
+}
+
+func GetDataTypeFiles(datatypeDir string) (datatypeFiles []string, err error) {
+	return GetJSONFiles(datatypeDir)
+}
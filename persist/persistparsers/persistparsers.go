@@ -9,6 +9,9 @@ import (
 	"github.com/ProtoML/ProtoML-persist/persist/elastic"
 	"encoding/json"
 	"github.com/ProtoML/ProtoML/types/constraintchecker"
+	"sort"
+	"strconv"
+	"strings"
 )
 
 const (
@@ -145,11 +148,159 @@ func ValidateInducedTransform(indt types.InducedTransform) (err error) {
 	}
 	return
 }
+
+func ValidateDataType(datatype types.DataType) (err error) {
+	if len(datatype.TypeName) == 0 {
+		err = errors.New("No datatype name")
+		return
+	}
+	for _, parent := range datatype.ParentTypes {
+		if parent == datatype.TypeName {
+			err = errors.New(fmt.Sprintf("Datatype %s lists itself as a parent", datatype.TypeName))
+			return
+		}
+	}
+	return
+}
+
+// parses a datatype definition file holding either a single datatype or a list of datatypes
+func ParseDataTypes(jsonBlob []byte) (datatypes []types.DataType, err error) {
+	err = json.Unmarshal(jsonBlob, &datatypes)
+	if err != nil {
+		var datatype types.DataType
+		if err = json.Unmarshal(jsonBlob, &datatype); err != nil {
+			return
+		}
+		datatypes = []types.DataType{datatype}
+	}
+	for _, datatype := range datatypes {
+		if err = ValidateDataType(datatype); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// orders datatypes so that every parent is registered before its children.
+// parents that are not in datatypes must satisfy registered.
+func SortDataTypes(datatypes []types.DataType, registered func(types.DataTypeName) bool) (sorted []types.DataType, err error) {
+	pending := make(map[types.DataTypeName]types.DataType)
+	order := make([]types.DataTypeName, 0, len(datatypes))
+	for _, datatype := range datatypes {
+		if _, ok := pending[datatype.TypeName]; ok {
+			err = errors.New(fmt.Sprintf("Datatype %s defined more than once", datatype.TypeName))
+			return
+		}
+		pending[datatype.TypeName] = datatype
+		order = append(order, datatype.TypeName)
+	}
+
+	// validate parents exist
+	for _, name := range order {
+		for _, parent := range pending[name].ParentTypes {
+			if _, ok := pending[parent]; !ok && !registered(parent) {
+				err = errors.New(fmt.Sprintf("Datatype %s has unknown parent %s", name, parent))
+				return
+			}
+		}
+	}
+
+	// repeatedly emit every datatype whose pending parents have all been emitted
+	sorted = make([]types.DataType, 0, len(datatypes))
+	for len(pending) > 0 {
+		progressed := false
+		for _, name := range order {
+			datatype, ok := pending[name]
+			if !ok {
+				continue
+			}
+			ready := true
+			for _, parent := range datatype.ParentTypes {
+				if _, ok := pending[parent]; ok {
+					ready = false
+					break
+				}
+			}
+			if ready {
+				sorted = append(sorted, datatype)
+				delete(pending, name)
+				progressed = true
+			}
+		}
+		if !progressed {
+			cycle := make([]string, 0, len(pending))
+			for _, name := range order {
+				if _, ok := pending[name]; ok {
+					cycle = append(cycle, string(name))
+				}
+			}
+			err = errors.New(fmt.Sprintf("Datatypes have cyclic parents: %s", strings.Join(cycle, ", ")))
+			return nil, err
+		}
+	}
+	return
+}
+
+func isBinaryValue(value string) bool {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "0", "1", "true", "false":
+		return true
+	}
+	return false
+}
+
+func isIntegerValue(value string) bool {
+	_, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+	return err == nil
+}
+
+func isRealValue(value string) bool {
+	_, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	return err == nil
+}
+
+func isAnyValue(value string) bool {
+	return true
+}
+
+// recognizers for the values of the default datatypes, used to infer and verify dataset columns.
+// other datatypes are recognized by their nearest default ancestor.
+var DataTypeValueParsers = map[types.DataTypeName]func(value string) bool{
+	"binary":      isBinaryValue,
+	"integer":     isIntegerValue,
+	"real":        isRealValue,
+	"categorical": isAnyValue,
+	"string":      isAnyValue,
+}
+
+// the value recognizer of a datatype, or of its nearest recognized ancestor when it has none.
+// ancestors are ordered nearest first as returned by elastic.GetDataTypeAncestors.
+func DataTypeValueParser(name types.DataTypeName, ancestors []types.DataTypeName) (parser func(value string) bool, ok bool) {
+	if parser, ok = DataTypeValueParsers[name]; ok {
+		return
+	}
+	for _, ancestor := range ancestors {
+		if parser, ok = DataTypeValueParsers[ancestor]; ok {
+			return
+		}
+	}
+	return nil, false
+}
+
+func IsDataTypeRegistered(name types.DataTypeName) bool {
+	_, err := elastic.GetDataType(name)
+	return err == nil
+}
+
 func LoadConfig(configFile string) (config persist.Config, err error) {
 	jsonBlob, err := osutils.LoadBlob(configFile)
 	if err != nil {
 		return
 	}
+	jsonBlob, err = expandInputFileRanges(jsonBlob)
+	if err != nil {
+		return
+	}
 	err = json.Unmarshal(jsonBlob, &config)
 	if err != nil {
 		return
@@ -180,25 +331,39 @@ func ValidateDatasetFile(dataFile types.DatasetFile) (err error) {
 		return err
 	}
 
-	// validate exclusive types fit correct indices
-	sumColIndexes := 0
-	for etype, indices := range dataFile.Columns.ExclusiveTypes {
-		for _, index := range indices{
+	// validate every column has exactly one exclusive type
+	typeNames := make([]string, 0, len(dataFile.Columns.ExclusiveTypes))
+	for etype := range dataFile.Columns.ExclusiveTypes {
+		typeNames = append(typeNames, string(etype))
+	}
+	sort.Strings(typeNames)
+	colTypes := make([][]string, dataFile.NCols)
+	for _, etype := range typeNames {
+		for _, index := range dataFile.Columns.ExclusiveTypes[types.DataTypeName(etype)] {
 			if index < 0 {
 				err = errors.New(fmt.Sprintf("Type %s has an index below 0", etype))
 				return
 			} 
 			if index >= dataFile.NCols {
-				err = errors.New(fmt.Sprintf("Type %s has an index not in range [0,number of cols)", etype))
+				err = errors.New(fmt.Sprintf("Type %s has index %d not in range [0,%d)", etype, index, dataFile.NCols))
 				return
 			}
-			sumColIndexes += index
+			colTypes[index] = append(colTypes[index], etype)
 		}
 	}
-	if sumColIndexes > (dataFile.NCols-1)*dataFile.NCols/2 {
-		err = errors.New("Too many indices compared to datafile column size specification")
-	} else if sumColIndexes < (dataFile.NCols-1)*dataFile.NCols/2 {
-		err = errors.New("Not enough indices compared to datafile column size specification")
+	duplicated := make([]string, 0)
+	missing := make([]int, 0)
+	for index, etypes := range colTypes {
+		if len(etypes) == 0 {
+			missing = append(missing, index)
+		} else if len(etypes) > 1 {
+			duplicated = append(duplicated, fmt.Sprintf("%d (%s)", index, strings.Join(etypes, ", ")))
+		}
+	}
+	if len(duplicated) > 0 {
+		err = errors.New(fmt.Sprintf("Columns assigned more than one exclusive type: %s", strings.Join(duplicated, "; ")))
+	} else if len(missing) > 0 {
+		err = errors.New(fmt.Sprintf("Columns without an exclusive type: %s", FormatColumnRanges(missing)))
 	}
 	if err != nil {
 		return
@@ -221,45 +386,164 @@ func ValidateDatasetFile(dataFile types.DatasetFile) (err error) {
 	return nil
 }
  
-func ParseDatasetFile(jsonBlob []byte) (dataFile types.DatasetFile, err error) {
-	err = json.Unmarshal(jsonBlob, &dataFile)
+// parses a column index list entry, either an index or an inclusive range such as "0-99".
+// ranges must end before nCols so a typo can't expand into an arbitrarily long list.
+func parseColumnIndices(entry json.RawMessage, nCols int) (indices []int, err error) {
+	var index int
+	if err = json.Unmarshal(entry, &index); err == nil {
+		return []int{index}, nil
+	}
+	var columnRange string
+	if err = json.Unmarshal(entry, &columnRange); err != nil {
+		return nil, errors.New(fmt.Sprintf("Column index %s is neither an index nor a range", entry))
+	}
+	bounds := strings.SplitN(strings.TrimSpace(columnRange), "-", 2)
+	first, err := strconv.Atoi(strings.TrimSpace(bounds[0]))
 	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Column range %q has a bad start", columnRange))
+	}
+	last := first
+	if len(bounds) == 2 {
+		if last, err = strconv.Atoi(strings.TrimSpace(bounds[1])); err != nil {
+			return nil, errors.New(fmt.Sprintf("Column range %q has a bad end", columnRange))
+		}
+	}
+	if last < first {
+		return nil, errors.New(fmt.Sprintf("Column range %q ends before it starts", columnRange))
+	}
+	if nCols <= 0 {
+		return nil, errors.New(fmt.Sprintf("Column range %q needs a positive number of columns", columnRange))
+	}
+	if last >= nCols {
+		return nil, errors.New(fmt.Sprintf("Column range %q ends past the last of %d columns", columnRange, nCols))
+	}
+	indices = make([]int, 0, last-first+1)
+	for index = first; index <= last; index++ {
+		indices = append(indices, index)
+	}
+	return
+}
+
+// expands the ranges in a map of column index lists of a dataset file with nCols columns
+func expandColumnMap(columnsJSON json.RawMessage, nCols int) (expanded map[string][]int, err error) {
+	var entries map[string][]json.RawMessage
+	if err = json.Unmarshal(columnsJSON, &entries); err != nil {
 		return
 	}
-	err = ValidateDatasetFile(dataFile)
+	expanded = make(map[string][]int)
+	for key, list := range entries {
+		expanded[key] = make([]int, 0, len(list))
+		for _, entry := range list {
+			indices, err := parseColumnIndices(entry, nCols)
+			if err != nil {
+				return nil, errors.New(fmt.Sprintf("%s: %s", key, err))
+			}
+			expanded[key] = append(expanded[key], indices...)
+		}
+	}
 	return
 }
 
+// rewrites the column index lists of a dataset file json object, expanding ranges such as "0-99"
+// into the indices they cover. ranges are bounded by the NCols of the dataset file.
+func ExpandColumnRanges(jsonBlob []byte) (expanded []byte, err error) {
+	var dataFile map[string]json.RawMessage
+	if err = json.Unmarshal(jsonBlob, &dataFile); err != nil {
+		return
+	}
+	// a missing or malformed NCols is left to validation, ranges are then rejected
+	var nCols int
+	if nColsJSON, ok := dataFile["NCols"]; ok {
+		json.Unmarshal(nColsJSON, &nCols)
+	}
+	columnsJSON, ok := dataFile["Columns"]
+	if !ok {
+		return jsonBlob, nil
+	}
+	var columns map[string]json.RawMessage
+	if err = json.Unmarshal(columnsJSON, &columns); err != nil {
+		return
+	}
+	for _, field := range []string{"ExclusiveTypes", "Tags"} {
+		if _, ok := columns[field]; !ok {
+			continue
+		}
+		lists, err := expandColumnMap(columns[field], nCols)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Bad column indices in %s: %s", field, err))
+		}
+		if columns[field], err = json.Marshal(lists); err != nil {
+			return nil, err
+		}
+	}
+	if dataFile["Columns"], err = json.Marshal(columns); err != nil {
+		return
+	}
+	return json.Marshal(dataFile)
+}
 
+// expands the column ranges of the input files of a config json object
+func expandInputFileRanges(jsonBlob []byte) (expanded []byte, err error) {
+	var config map[string]json.RawMessage
+	if err = json.Unmarshal(jsonBlob, &config); err != nil {
+		return
+	}
+	var storage map[string]json.RawMessage
+	if _, ok := config["LocalPersistStorage"]; !ok {
+		return jsonBlob, nil
+	}
+	if err = json.Unmarshal(config["LocalPersistStorage"], &storage); err != nil {
+		return
+	}
+	var inputFiles []json.RawMessage
+	if _, ok := storage["InputFiles"]; !ok {
+		return jsonBlob, nil
+	}
+	if err = json.Unmarshal(storage["InputFiles"], &inputFiles); err != nil {
+		return
+	}
+	for i, inputFile := range inputFiles {
+		if inputFiles[i], err = ExpandColumnRanges(inputFile); err != nil {
+			return nil, errors.New(fmt.Sprintf("Input file %d: %s", i, err))
+		}
+	}
+	if storage["InputFiles"], err = json.Marshal(inputFiles); err != nil {
+		return
+	}
+	if config["LocalPersistStorage"], err = json.Marshal(storage); err != nil {
+		return
+	}
+	return json.Marshal(config)
+}
 
-/*func ParseExternalTransforms(store PersistStorage, externalTransformDirectories []string) (transforms []types.Transform, err error) {
-=======
-// Doesn't build, no persist storage
-func ParseExternalTransforms(store PersistStorage, externalTransformDirectories []string) (transforms []types.Transform, err error) {
->>>>>>> zmjjmz/master
-	transforms = make([]types.Transform, 0)
-	for _, transformDir := range externalTransformDirectories {
-		dir, err := os.Open(transformDir)
-		if err != nil {
-			return transforms, err
+// formats sorted column indices collapsing consecutive runs into ranges, such as "0-3, 7"
+func FormatColumnRanges(indices []int) string {
+	ranges := make([]string, 0)
+	for start := 0; start < len(indices); {
+		end := start
+		for end+1 < len(indices) && indices[end+1] == indices[end]+1 {
+			end++
 		}
-		defer dir.Close()
-		files, err := dir.Readdir(0)
-		for _, file := range files {
-			// load all json files in directory as transforms
-			if !file.IsDir() && strings.HasSuffix(strings.ToLower(file.Name()), ".json") {
-				jsonBlob, err := osutils.LoadBlob(path.Join(transformDir, file.Name()))
-				if err != nil {
-					return transforms, err
-				}
-				transform, err := ParseTransform(jsonBlob)
-				if err != nil {
-					return transforms, err
-				}
-				transforms = append(transforms, transform)
-			}
+		if end == start {
+			ranges = append(ranges, strconv.Itoa(indices[start]))
+		} else {
+			ranges = append(ranges, fmt.Sprintf("%d-%d", indices[start], indices[end]))
 		}
+		start = end + 1
+	}
+	return strings.Join(ranges, ", ")
+}
+
+func ParseDatasetFile(jsonBlob []byte) (dataFile types.DatasetFile, err error) {
+	jsonBlob, err = ExpandColumnRanges(jsonBlob)
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(jsonBlob, &dataFile)
+	if err != nil {
+		return
 	}
+	err = ValidateDatasetFile(dataFile)
 	return
 }
-*/
+
@@ -1 +1,158 @@
 package persistparsers
+
+import (
+	"github.com/ProtoML/ProtoML/types"
+	"strings"
+	"testing"
+)
+
+func TestSortDataTypes(t *testing.T) {
+	registered := func(name types.DataTypeName) bool { return name == "base" }
+	datatypes := []types.DataType{
+		{TypeName: "leaf", ParentTypes: []types.DataTypeName{"mid"}},
+		{TypeName: "mid", ParentTypes: []types.DataTypeName{"base"}},
+		{TypeName: "other", ParentTypes: []types.DataTypeName{"base", "leaf"}},
+	}
+	sorted, err := SortDataTypes(datatypes, registered)
+	if err != nil {
+		t.Fatalf("SortDataTypes returned error: %s", err)
+	}
+	position := make(map[types.DataTypeName]int)
+	for i, datatype := range sorted {
+		position[datatype.TypeName] = i
+	}
+	if len(sorted) != len(datatypes) {
+		t.Fatalf("len(SortDataTypes) = %d, want %d", len(sorted), len(datatypes))
+	}
+	if position["mid"] > position["leaf"] || position["leaf"] > position["other"] {
+		t.Errorf("SortDataTypes returned parents after children: %v", sorted)
+	}
+}
+
+func TestSortDataTypesUnknownParent(t *testing.T) {
+	registered := func(name types.DataTypeName) bool { return false }
+	datatypes := []types.DataType{
+		{TypeName: "leaf", ParentTypes: []types.DataTypeName{"missing"}},
+	}
+	if _, err := SortDataTypes(datatypes, registered); err == nil {
+		t.Errorf("SortDataTypes accepted a datatype with an unknown parent")
+	}
+}
+
+func TestSortDataTypesCycle(t *testing.T) {
+	registered := func(name types.DataTypeName) bool { return false }
+	datatypes := []types.DataType{
+		{TypeName: "a", ParentTypes: []types.DataTypeName{"b"}},
+		{TypeName: "b", ParentTypes: []types.DataTypeName{"a"}},
+	}
+	if _, err := SortDataTypes(datatypes, registered); err == nil {
+		t.Errorf("SortDataTypes accepted cyclic datatypes")
+	}
+}
+
+func TestDataTypeValueParser(t *testing.T) {
+	parser, ok := DataTypeValueParser("integer", nil)
+	if !ok {
+		t.Fatalf("DataTypeValueParser found no parser for integer")
+	}
+	if !parser("42") || parser("4.2") {
+		t.Errorf("integer parser accepts the wrong values")
+	}
+
+	// unknown datatypes use their nearest recognized ancestor
+	parser, ok = DataTypeValueParser("price", []types.DataTypeName{"money", "real", "string"})
+	if !ok {
+		t.Fatalf("DataTypeValueParser found no parser for an ancestor of price")
+	}
+	if !parser("4.2") || parser("four") {
+		t.Errorf("price parser does not parse as its real ancestor")
+	}
+
+	if _, ok = DataTypeValueParser("price", []types.DataTypeName{"money"}); ok {
+		t.Errorf("DataTypeValueParser found a parser for a datatype without recognized ancestors")
+	}
+}
+
+func TestDataTypeValueParsersAreDefaultDataTypes(t *testing.T) {
+	defaults := make(map[types.DataTypeName]bool)
+	for _, datatype := range types.DefaultDataTypes {
+		defaults[datatype.TypeName] = true
+	}
+	for name := range DataTypeValueParsers {
+		if !defaults[name] {
+			t.Errorf("DataTypeValueParsers has a parser for %s, which is not a default datatype", name)
+		}
+	}
+}
+
+func coverageDatasetFile(ncols int, exclusiveTypes map[types.DataTypeName][]int) types.DatasetFile {
+	return types.DatasetFile{
+		Path:       "data.csv",
+		FileFormat: "csv",
+		NRows:      10,
+		NCols:      ncols,
+		Columns: types.DatasetColumns{
+			ExclusiveTypes: exclusiveTypes,
+			Tags:           map[string][]int{"all": {0}},
+		},
+	}
+}
+
+func TestValidateDatasetFileCoverage(t *testing.T) {
+	valid := coverageDatasetFile(4, map[types.DataTypeName][]int{"real": {0, 2}, "string": {3, 1}})
+	if err := ValidateDatasetFile(valid); err != nil {
+		t.Errorf("ValidateDatasetFile rejected exact coverage: %s", err)
+	}
+
+	// sums to the same total as 0, 1, 2, 3
+	duplicated := coverageDatasetFile(4, map[types.DataTypeName][]int{"real": {0, 3}, "string": {0, 3}})
+	err := ValidateDatasetFile(duplicated)
+	if err == nil {
+		t.Fatalf("ValidateDatasetFile accepted duplicated columns")
+	}
+	if !strings.Contains(err.Error(), "0 (real, string)") {
+		t.Errorf("ValidateDatasetFile error does not name the duplicated column: %s", err)
+	}
+
+	missing := coverageDatasetFile(6, map[types.DataTypeName][]int{"real": {0, 4}})
+	err = ValidateDatasetFile(missing)
+	if err == nil {
+		t.Fatalf("ValidateDatasetFile accepted missing columns")
+	}
+	if !strings.Contains(err.Error(), "1-3, 5") {
+		t.Errorf("ValidateDatasetFile error does not name the missing columns: %s", err)
+	}
+}
+
+func TestParseDatasetFileRanges(t *testing.T) {
+	jsonBlob := []byte(`{
+		"Path": "data.csv",
+		"FileFormat": "csv",
+		"NRows": 10,
+		"NCols": 100,
+		"Columns": {
+			"ExclusiveTypes": {"real": ["0-98"], "string": [99]},
+			"Tags": {"features": ["0-49", "60-98"], "label": [99]}
+		}
+	}`)
+	dataFile, err := ParseDatasetFile(jsonBlob)
+	if err != nil {
+		t.Fatalf("ParseDatasetFile returned error: %s", err)
+	}
+	if n := len(dataFile.Columns.ExclusiveTypes["real"]); n != 99 {
+		t.Errorf("range 0-98 expanded to %d columns, want 99", n)
+	}
+	if n := len(dataFile.Columns.Tags["features"]); n != 89 {
+		t.Errorf("ranges 0-49 and 60-98 expanded to %d columns, want 89", n)
+	}
+
+	if _, err = ParseDatasetFile([]byte(`{"NCols": 10, "Columns": {"ExclusiveTypes": {"real": ["9-0"]}}}`)); err == nil {
+		t.Errorf("ParseDatasetFile accepted a range ending before it starts")
+	}
+	if _, err = ParseDatasetFile([]byte(`{"NCols": 10, "Columns": {"ExclusiveTypes": {"real": ["0-999999999"]}}}`)); err == nil {
+		t.Errorf("ParseDatasetFile accepted a range ending past NCols")
+	}
+	if _, err = ParseDatasetFile([]byte(`{"Columns": {"ExclusiveTypes": {"real": ["0-9"]}}}`)); err == nil {
+		t.Errorf("ParseDatasetFile accepted a range without NCols")
+	}
+}